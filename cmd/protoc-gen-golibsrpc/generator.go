@@ -0,0 +1,392 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"go/format"
+	"path"
+	"sort"
+	"strings"
+	"text/template"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/protobuf/protoc-gen-go/descriptor"
+	plugin "github.com/golang/protobuf/protoc-gen-go/plugin"
+)
+
+const (
+	defaultPBPrefix = "gen/pb"
+	rpcImportPath   = "github.com/xinlaini/golibs/rpc"
+)
+
+var (
+	// reservedMethodNames can't name generated client methods, since the embedded *rpc.Client
+	// already has them.
+	reservedMethodNames = map[string]bool{
+		"Call":               true,
+		"CallBatch":          true,
+		"CallWithTextPB":     true,
+		"Client":             true,
+		"Close":              true,
+		"Go":                 true,
+		"MirrorDiffs":        true,
+		"MirrorStats":        true,
+		"State":              true,
+		"Stats":              true,
+		"WaitForReady":       true,
+		"WaitForStateChange": true,
+	}
+
+	fileTemplate = template.Must(template.New("file").Parse(`// Code generated by protoc-gen-golibsrpc. DO NOT EDIT.
+// source: {{.Source}}
+
+package {{.Package}}
+
+import (
+	"reflect"
+{{range .Imports}}
+	{{.Alias}} "{{.Path}}"
+{{- end}}
+
+	"{{.RPCImportPath}}"
+)
+{{range .Services}}
+const {{.Name}}ServiceName = "{{.Name}}"
+
+// {{.Name}}Service is implemented by servers of the {{.Name}} service.
+type {{.Name}}Service interface {
+{{- range .Methods}}
+	{{.Name}}(ctx *rpc.ServerContext, req *{{.Input}}) (*{{.Output}}, error)
+{{- end}}
+}
+
+var {{.Name}}ServiceType = reflect.TypeOf((*{{.Name}}Service)(nil)).Elem()
+
+// New{{.Name}}ServiceConfig makes impl servable as {{.Name}}ServiceName by an rpc.Controller.
+func New{{.Name}}ServiceConfig(impl {{.Name}}Service) rpc.ServiceConfig {
+	return rpc.ServiceConfig{
+		Type: {{.Name}}ServiceType,
+		Impl: impl,
+	}
+}
+
+// {{.Name}}Client is a typed client of the {{.Name}} service.
+type {{.Name}}Client struct {
+	*rpc.Client
+}
+
+// New{{.Name}}Client creates a client, opts.ServiceName defaults to {{.Name}}ServiceName.
+func New{{.Name}}Client(ctrl *rpc.Controller, opts rpc.ClientOptions) (*{{.Name}}Client, error) {
+	if opts.ServiceName == "" {
+		opts.ServiceName = {{.Name}}ServiceName
+	}
+	c, err := ctrl.NewClient(opts)
+	if err != nil {
+		return nil, err
+	}
+	return &{{.Name}}Client{Client: c}, nil
+}
+{{$service := .Name}}
+{{- range .Methods}}
+func (c *{{$service}}Client) {{.Name}}(ctx *rpc.ClientContext, req *{{.Input}}) (*{{.Output}}, error) {
+	resp, err := c.Call("{{.Name}}", ctx, req, reflect.TypeOf({{.Output}}{}))
+	if resp == nil {
+		return nil, err
+	}
+	return resp.(*{{.Output}}), err
+}
+{{end -}}
+{{end -}}
+`))
+)
+
+type goImport struct {
+	Alias string
+	Path  string
+}
+
+type methodData struct {
+	Name   string
+	Input  string
+	Output string
+}
+
+type serviceData struct {
+	Name    string
+	Methods []methodData
+}
+
+type fileData struct {
+	Source        string
+	Package       string
+	Imports       []goImport
+	RPCImportPath string
+	Services      []serviceData
+}
+
+type params struct {
+	pkg         string
+	pbPrefix    string
+	importPaths map[string]string
+}
+
+// goMessage is where the Go type of a proto message lives.
+type goMessage struct {
+	file     *descriptor.FileDescriptorProto
+	typeName string
+}
+
+type generator struct {
+	params params
+	// messages indexes all known messages by fully-qualified proto name, e.g. ".foo.Bar".
+	messages map[string]goMessage
+}
+
+func parseParams(parameter string) (params, error) {
+	p := params{
+		pbPrefix:    defaultPBPrefix,
+		importPaths: make(map[string]string),
+	}
+	if parameter == "" {
+		return p, nil
+	}
+	for _, kv := range strings.Split(parameter, ",") {
+		i := strings.Index(kv, "=")
+		if i < 0 {
+			return p, fmt.Errorf("Parameter '%s' is not KEY=VALUE", kv)
+		}
+		key, value := kv[:i], kv[i+1:]
+		switch {
+		case key == "package":
+			p.pkg = value
+		case key == "pb_prefix":
+			p.pbPrefix = value
+		case strings.HasPrefix(key, "M"):
+			p.importPaths[key[1:]] = value
+		default:
+			return p, fmt.Errorf("Unknown parameter '%s'", key)
+		}
+	}
+	return p, nil
+}
+
+func (g *generator) indexMessages(
+	file *descriptor.FileDescriptorProto, prefix, goPrefix string, msgs []*descriptor.DescriptorProto) {
+	for _, msg := range msgs {
+		name := prefix + "." + msg.GetName()
+		typeName := goPrefix + camelCase(msg.GetName())
+		g.messages[name] = goMessage{file: file, typeName: typeName}
+		g.indexMessages(file, name, typeName+"_", msg.GetNestedType())
+	}
+}
+
+// importPath returns the Go import path of the messages of file.
+func (g *generator) importPath(file *descriptor.FileDescriptorProto) string {
+	if importPath, found := g.params.importPaths[file.GetName()]; found {
+		return importPath
+	}
+	goPackage := file.GetOptions().GetGoPackage()
+	if i := strings.Index(goPackage, ";"); i >= 0 {
+		goPackage = goPackage[:i]
+	}
+	if strings.Contains(goPackage, "/") {
+		return goPackage
+	}
+	return path.Join(g.params.pbPrefix, strings.TrimSuffix(file.GetName(), ".proto")+"_proto")
+}
+
+// goPackageName returns the Go package name of the messages of file.
+func goPackageName(file *descriptor.FileDescriptorProto) string {
+	goPackage := file.GetOptions().GetGoPackage()
+	if i := strings.Index(goPackage, ";"); i >= 0 {
+		return goPackage[i+1:]
+	}
+	if goPackage != "" {
+		return path.Base(goPackage)
+	}
+	if pkg := file.GetPackage(); pkg != "" {
+		return pkg[strings.LastIndex(pkg, ".")+1:]
+	}
+	return strings.TrimSuffix(path.Base(file.GetName()), ".proto")
+}
+
+func (g *generator) generateFile(file *descriptor.FileDescriptorProto) (*plugin.CodeGeneratorResponse_File, error) {
+	data := &fileData{
+		Source:        file.GetName(),
+		Package:       g.params.pkg,
+		RPCImportPath: rpcImportPath,
+	}
+	if data.Package == "" {
+		pkg := file.GetPackage()
+		if pkg == "" {
+			return nil, fmt.Errorf("'%s' has no package, set the 'package' parameter", file.GetName())
+		}
+		data.Package = pkg[strings.LastIndex(pkg, ".")+1:]
+	}
+
+	// Import aliases by import path, unique within the generated file.
+	aliases := make(map[string]string)
+	taken := map[string]bool{data.Package: true, "reflect": true, "rpc": true}
+	qualify := func(protoType string) (string, error) {
+		msg, found := g.messages[protoType]
+		if !found {
+			return "", fmt.Errorf("Unknown message type '%s'", protoType)
+		}
+		importPath := g.importPath(msg.file)
+		alias, found := aliases[importPath]
+		if !found {
+			base := goPackageName(msg.file)
+			alias = base
+			for i := 2; taken[alias]; i++ {
+				alias = fmt.Sprintf("%s%d", base, i)
+			}
+			taken[alias] = true
+			aliases[importPath] = alias
+		}
+		return alias + "." + msg.typeName, nil
+	}
+
+	for _, svc := range file.GetService() {
+		svcData := serviceData{Name: camelCase(svc.GetName())}
+		for _, m := range svc.GetMethod() {
+			if m.GetClientStreaming() || m.GetServerStreaming() {
+				return nil, fmt.Errorf(
+					"Method '%s.%s' is streaming, which is not supported", svc.GetName(), m.GetName())
+			}
+			name := camelCase(m.GetName())
+			if reservedMethodNames[name] {
+				return nil, fmt.Errorf(
+					"Method '%s.%s' would shadow rpc.Client.%s in the generated client, rename it",
+					svc.GetName(), m.GetName(), name)
+			}
+			input, err := qualify(m.GetInputType())
+			if err != nil {
+				return nil, err
+			}
+			output, err := qualify(m.GetOutputType())
+			if err != nil {
+				return nil, err
+			}
+			svcData.Methods = append(svcData.Methods, methodData{
+				Name:   name,
+				Input:  input,
+				Output: output,
+			})
+		}
+		data.Services = append(data.Services, svcData)
+	}
+
+	for importPath, alias := range aliases {
+		data.Imports = append(data.Imports, goImport{Alias: alias, Path: importPath})
+	}
+	sort.Sort(byPath(data.Imports))
+
+	buf := &bytes.Buffer{}
+	if err := fileTemplate.Execute(buf, data); err != nil {
+		return nil, err
+	}
+	content, err := format.Source(buf.Bytes())
+	if err != nil {
+		return nil, fmt.Errorf("Failed to format code generated for '%s': %s", file.GetName(), err)
+	}
+	return &plugin.CodeGeneratorResponse_File{
+		Name:    proto.String(strings.TrimSuffix(file.GetName(), ".proto") + ".rpc.go"),
+		Content: proto.String(string(content)),
+	}, nil
+}
+
+// generate generates one file per file to generate that defines services.
+func generate(request *plugin.CodeGeneratorRequest) ([]*plugin.CodeGeneratorResponse_File, error) {
+	p, err := parseParams(request.GetParameter())
+	if err != nil {
+		return nil, err
+	}
+	g := &generator{
+		params:   p,
+		messages: make(map[string]goMessage),
+	}
+	files := make(map[string]*descriptor.FileDescriptorProto)
+	for _, file := range request.GetProtoFile() {
+		files[file.GetName()] = file
+		prefix := ""
+		if file.GetPackage() != "" {
+			prefix = "." + file.GetPackage()
+		}
+		g.indexMessages(file, prefix, "", file.GetMessageType())
+	}
+
+	var generated []*plugin.CodeGeneratorResponse_File
+	for _, name := range request.GetFileToGenerate() {
+		file, found := files[name]
+		if !found {
+			return nil, fmt.Errorf("Missing descriptor of '%s'", name)
+		}
+		if len(file.GetService()) == 0 {
+			continue
+		}
+		out, err := g.generateFile(file)
+		if err != nil {
+			return nil, err
+		}
+		generated = append(generated, out)
+	}
+	return generated, nil
+}
+
+// camelCase converts a proto name to a Go name the way protoc-gen-go does, e.g. "foo_bar" to
+// "FooBar".
+func camelCase(s string) string {
+	if s == "" {
+		return ""
+	}
+	var buf bytes.Buffer
+	i := 0
+	if s[0] == '_' {
+		// A Go name needs a capital letter.
+		buf.WriteByte('X')
+		i++
+	}
+	// Words start at an underscore followed by a lower case letter, which is dropped, or at any
+	// other character. Digits are words of their own.
+	for ; i < len(s); i++ {
+		c := s[i]
+		if c == '_' && i+1 < len(s) && isLower(s[i+1]) {
+			continue
+		}
+		if isDigit(c) {
+			buf.WriteByte(c)
+			continue
+		}
+		if isLower(c) {
+			c -= 'a' - 'A'
+		}
+		buf.WriteByte(c)
+		for i+1 < len(s) && isLower(s[i+1]) {
+			i++
+			buf.WriteByte(s[i])
+		}
+	}
+	return buf.String()
+}
+
+func isLower(c byte) bool {
+	return 'a' <= c && c <= 'z'
+}
+
+func isDigit(c byte) bool {
+	return '0' <= c && c <= '9'
+}
+
+type byPath []goImport
+
+func (imports byPath) Len() int {
+	return len(imports)
+}
+
+func (imports byPath) Less(i, j int) bool {
+	return imports[i].Path < imports[j].Path
+}
+
+func (imports byPath) Swap(i, j int) {
+	imports[i], imports[j] = imports[j], imports[i]
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"flag"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/protobuf/protoc-gen-go/descriptor"
+	plugin "github.com/golang/protobuf/protoc-gen-go/plugin"
+
+	"github.com/xinlaini/golibs/rpc"
+)
+
+var update = flag.Bool("update", false, "Rewrite the golden files in testdata")
+
+func message(name string, nested ...*descriptor.DescriptorProto) *descriptor.DescriptorProto {
+	return &descriptor.DescriptorProto{Name: proto.String(name), NestedType: nested}
+}
+
+func method(name, input, output string) *descriptor.MethodDescriptorProto {
+	return &descriptor.MethodDescriptorProto{
+		Name:       proto.String(name),
+		InputType:  proto.String(input),
+		OutputType: proto.String(output),
+	}
+}
+
+// helloRequest is modeled on the protos of rpc/example. Unlike there, the Hello service shares
+// its package name with messages of hello.proto, and has methods named unlike Go methods.
+func helloRequest() *plugin.CodeGeneratorRequest {
+	return &plugin.CodeGeneratorRequest{
+		FileToGenerate: []string{"rpc/example/hello.proto"},
+		ProtoFile: []*descriptor.FileDescriptorProto{
+			{
+				Name:        proto.String("rpc/example/say.proto"),
+				Package:     proto.String("say"),
+				MessageType: []*descriptor.DescriptorProto{message("Request"), message("Response")},
+			},
+			{
+				Name:    proto.String("rpc/example/sing.proto"),
+				Package: proto.String("sing"),
+				MessageType: []*descriptor.DescriptorProto{
+					message("Request"),
+					message("Response", message("Verse")),
+				},
+				Options: &descriptor.FileOptions{GoPackage: proto.String("example.com/songs;songs")},
+			},
+			{
+				Name:        proto.String("rpc/example/hello.proto"),
+				Package:     proto.String("hello"),
+				Dependency:  []string{"rpc/example/say.proto", "rpc/example/sing.proto"},
+				MessageType: []*descriptor.DescriptorProto{message("Header")},
+				Service: []*descriptor.ServiceDescriptorProto{
+					{
+						Name: proto.String("Hello"),
+						Method: []*descriptor.MethodDescriptorProto{
+							method("Say", ".say.Request", ".say.Response"),
+							method("Sing", ".sing.Request", ".sing.Response"),
+							method("SingVerse", ".sing.Request", ".sing.Response.Verse"),
+							method("Echo", ".hello.Header", ".hello.Header"),
+							method("echo_2x", ".hello.Header", ".hello.Header"),
+							method("_ping", ".hello.Header", ".hello.Header"),
+						},
+					},
+				},
+			},
+		},
+	}
+}
+
+func TestGenerateGolden(t *testing.T) {
+	files, err := generate(helloRequest())
+	if err != nil {
+		t.Fatalf("generate failed: %s", err)
+	}
+	if len(files) != 1 {
+		t.Fatalf("Got %d generated files, want 1", len(files))
+	}
+	if got, want := files[0].GetName(), "rpc/example/hello.rpc.go"; got != want {
+		t.Errorf("Got generated file '%s', want '%s'", got, want)
+	}
+
+	golden := filepath.Join("testdata", "hello.rpc.go.golden")
+	if *update {
+		if err = ioutil.WriteFile(golden, []byte(files[0].GetContent()), 0644); err != nil {
+			t.Fatalf("Failed to update '%s': %s", golden, err)
+		}
+	}
+	want, err := ioutil.ReadFile(golden)
+	if err != nil {
+		t.Fatalf("Failed to read '%s': %s", golden, err)
+	}
+	if got := files[0].GetContent(); got != string(want) {
+		t.Errorf("Generated code differs from '%s', rerun with -update if intended. Got:\n%s", golden, got)
+	}
+}
+
+func TestGenerateErrors(t *testing.T) {
+	for _, tc := range []struct {
+		desc    string
+		mutate  func(*plugin.CodeGeneratorRequest)
+		wantErr string
+	}{
+		{
+			desc: "streaming",
+			mutate: func(request *plugin.CodeGeneratorRequest) {
+				request.ProtoFile[2].Service[0].Method[0].ServerStreaming = proto.Bool(true)
+			},
+			wantErr: "is streaming",
+		},
+		{
+			desc: "unknown type",
+			mutate: func(request *plugin.CodeGeneratorRequest) {
+				request.ProtoFile[2].Service[0].Method[0].InputType = proto.String(".say.Missing")
+			},
+			wantErr: "Unknown message type",
+		},
+		{
+			desc: "reserved method name",
+			mutate: func(request *plugin.CodeGeneratorRequest) {
+				request.ProtoFile[2].Service[0].Method[0].Name = proto.String("close")
+			},
+			wantErr: "would shadow rpc.Client.Close",
+		},
+		{
+			desc: "bad parameter",
+			mutate: func(request *plugin.CodeGeneratorRequest) {
+				request.Parameter = proto.String("pb_prefix")
+			},
+			wantErr: "is not KEY=VALUE",
+		},
+	} {
+		request := helloRequest()
+		tc.mutate(request)
+		if _, err := generate(request); err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+			t.Errorf("%s: got error %v, want one containing '%s'", tc.desc, err, tc.wantErr)
+		}
+	}
+}
+
+func TestReservedMethodNames(t *testing.T) {
+	clientType := reflect.TypeOf(&rpc.Client{})
+	for i := 0; i < clientType.NumMethod(); i++ {
+		if name := clientType.Method(i).Name; !reservedMethodNames[name] {
+			t.Errorf("rpc.Client.%s is missing from reservedMethodNames", name)
+		}
+	}
+	for name := range reservedMethodNames {
+		if _, found := clientType.MethodByName(name); !found && name != "Client" {
+			t.Errorf("reservedMethodNames has '%s', which rpc.Client doesn't", name)
+		}
+	}
+}
+
+func TestCamelCase(t *testing.T) {
+	for in, want := range map[string]string{
+		"say":        "Say",
+		"say_hello":  "SayHello",
+		"SayHello":   "SayHello",
+		"say_2times": "Say_2Times",
+		"_say":       "XSay",
+		"say2x":      "Say2X",
+		"SAY_hello":  "SAYHello",
+		"":           "",
+	} {
+		if got := camelCase(in); got != want {
+			t.Errorf("camelCase(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
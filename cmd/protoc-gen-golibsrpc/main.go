@@ -0,0 +1,58 @@
+// Command protoc-gen-golibsrpc is a protoc plugin generating Go bindings of the rpc package for
+// the services in proto files. For a service Foo it generates:
+//
+//   - the FooService interface implemented by servers, and FooServiceType for ServiceConfig,
+//   - NewFooServiceConfig, which wraps an implementation into an rpc.ServiceConfig,
+//   - the FooClient type with one typed method per rpc, created by NewFooClient.
+//
+// Usage:
+//
+//	protoc --golibsrpc_out=[PARAMS:]OUT_DIR foo/bar/svc.proto
+//
+// which writes OUT_DIR/foo/bar/svc.rpc.go. PARAMS is a comma-separated list of:
+//
+//	package=NAME      Go package name of the generated file, defaults to the last component of
+//	                  the proto package.
+//	pb_prefix=PATH    Go import path prefix of the message packages, "gen/pb" by default. The
+//	                  messages of foo/bar/msg.proto are imported from PATH/foo/bar/msg_proto.
+//	Mfoo/bar/msg.proto=PATH
+//	                  Imports the messages of foo/bar/msg.proto from PATH instead.
+//
+// The go_package option of a proto file, if it contains a '/', takes precedence over pb_prefix.
+package main
+
+import (
+	"io/ioutil"
+	"os"
+
+	"github.com/golang/protobuf/proto"
+	plugin "github.com/golang/protobuf/protoc-gen-go/plugin"
+	"github.com/xinlaini/golibs/log"
+)
+
+func main() {
+	logger := xlog.NewPlainLogger()
+
+	data, err := ioutil.ReadAll(os.Stdin)
+	if err != nil {
+		logger.Fatalf("Failed to read CodeGeneratorRequest: %s", err)
+	}
+	request := &plugin.CodeGeneratorRequest{}
+	if err = proto.Unmarshal(data, request); err != nil {
+		logger.Fatalf("Failed to unmarshal CodeGeneratorRequest: %s", err)
+	}
+
+	response := &plugin.CodeGeneratorResponse{}
+	if response.File, err = generate(request); err != nil {
+		// Reported by protoc along with the name of the plugin.
+		response.File = nil
+		response.Error = proto.String(err.Error())
+	}
+
+	if data, err = proto.Marshal(response); err != nil {
+		logger.Fatalf("Failed to marshal CodeGeneratorResponse: %s", err)
+	}
+	if _, err = os.Stdout.Write(data); err != nil {
+		logger.Fatalf("Failed to write CodeGeneratorResponse: %s", err)
+	}
+}
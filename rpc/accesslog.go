@@ -0,0 +1,250 @@
+package rpc
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/rand"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"gen/pb/rpc/rpc_proto"
+
+	"github.com/xinlaini/golibs/log"
+)
+
+const (
+	DefaultAccessLogMaxSize    = 100 << 20
+	DefaultAccessLogMaxBackups = 5
+
+	accessLogBufferSize = 1024
+)
+
+type AccessLogFormat int
+
+const (
+	AccessLogText AccessLogFormat = iota
+	AccessLogJSON
+)
+
+// AccessLogConfig enables a log with one line per served request.
+type AccessLogConfig struct {
+	Path   string
+	Format AccessLogFormat
+	// MaxSize is the size in bytes beyond which Path is rotated to Path.1, Path.1 to Path.2
+	// and so on, keeping MaxBackups old files. They default to DefaultAccessLogMaxSize and
+	// DefaultAccessLogMaxBackups.
+	MaxSize    int64
+	MaxBackups int
+	// SampleRate is the fraction of successful requests logged, in (0, 1], defaults to 1.
+	// Failed requests are always logged.
+	SampleRate float64
+}
+
+type accessLogEntry struct {
+	Time         time.Time `json:"time"`
+	ClientAddr   string    `json:"client_addr"`
+	ClientJob    string    `json:"client_job"`
+	Service      string    `json:"service"`
+	Method       string    `json:"method"`
+	Status       string    `json:"status"`
+	Error        string    `json:"error,omitempty"`
+	LatencyUs    int64     `json:"latency_us"`
+	RequestSize  int       `json:"request_size"`
+	ResponseSize int       `json:"response_size"`
+}
+
+func (entry *accessLogEntry) format(format AccessLogFormat) ([]byte, error) {
+	if format == AccessLogJSON {
+		line, err := json.Marshal(entry)
+		return append(line, '\n'), err
+	}
+	// Requests rejected before dispatch have no method.
+	method := "-"
+	if entry.Service != "" {
+		method = entry.Service + "." + entry.Method
+	}
+	line := fmt.Sprintf(
+		"%s %s %s %s %s %dus %d %d",
+		entry.Time.UTC().Format(time.RFC3339Nano),
+		entry.ClientAddr,
+		strconv.Quote(entry.ClientJob),
+		method,
+		entry.Status,
+		entry.LatencyUs,
+		entry.RequestSize,
+		entry.ResponseSize)
+	if entry.Error != "" {
+		line += " " + strconv.Quote(entry.Error)
+	}
+	return []byte(line + "\n"), nil
+}
+
+// accessLog writes entries in the background, so that serving never waits for the disk. It
+// drops entries if writing falls behind.
+type accessLog struct {
+	logger xlog.Logger
+	config AccessLogConfig
+	ch     chan *accessLogEntry
+
+	file *os.File
+	size int64
+
+	rnd     *rand.Rand
+	dropped int64
+	mtx     sync.Mutex
+}
+
+// record logs the request, subject to sampling. A nil response means the connection was
+// dropped.
+func (al *accessLog) record(
+	request *rpc_proto.Request, response *rpc_proto.Response, received time.Time) {
+	al.mtx.Lock()
+	if response != nil && response.Error == nil && al.rnd.Float64() >= al.config.SampleRate {
+		al.mtx.Unlock()
+		return
+	}
+	al.mtx.Unlock()
+
+	reqMeta := request.Metadata
+	entry := &accessLogEntry{
+		Time:        received,
+		ClientAddr:  reqMeta.GetClientAddr(),
+		ClientJob:   reqMeta.GetClientJobName(),
+		Service:     reqMeta.GetServiceName(),
+		Method:      reqMeta.GetMethodName(),
+		Status:      "OK",
+		LatencyUs:   int64(time.Now().Sub(received) / time.Microsecond),
+		RequestSize: len(request.RequestPb),
+	}
+	if response == nil {
+		entry.Status = "DROPPED"
+	} else if entry.ResponseSize = len(response.ResponsePb); response.Error != nil {
+		entry.Status = "ERROR"
+		entry.Error = response.GetError()
+	}
+	al.push(entry)
+}
+
+// recordRejected logs a request, or a connection, rejected before it could be dispatched, e.g.
+// as it failed to unmarshal. Such requests have no service or method.
+func (al *accessLog) recordRejected(clientAddr string, received time.Time, requestSize int, err string) {
+	al.push(&accessLogEntry{
+		Time:        received,
+		ClientAddr:  clientAddr,
+		Status:      "ERROR",
+		Error:       err,
+		LatencyUs:   int64(time.Now().Sub(received) / time.Microsecond),
+		RequestSize: requestSize,
+	})
+}
+
+func (al *accessLog) push(entry *accessLogEntry) {
+	select {
+	case al.ch <- entry:
+	default:
+		al.mtx.Lock()
+		al.dropped++
+		al.mtx.Unlock()
+	}
+}
+
+func (al *accessLog) writeLoop() {
+	for entry := range al.ch {
+		line, err := entry.format(al.config.Format)
+		if err != nil {
+			al.logger.Errorf("Failed to format access log entry: %s", err)
+			continue
+		}
+		if al.size+int64(len(line)) > al.config.MaxSize && al.size > 0 {
+			if err = al.rotate(); err != nil {
+				al.logger.Errorf("Failed to rotate access log '%s': %s", al.config.Path, err)
+			}
+		}
+		if al.file == nil {
+			continue
+		}
+		al.mtx.Lock()
+		if dropped := al.dropped; dropped > 0 {
+			al.dropped = 0
+			al.mtx.Unlock()
+			al.logger.Errorf("Dropped %d access log entries, writing fell behind", dropped)
+		} else {
+			al.mtx.Unlock()
+		}
+		n, err := al.file.Write(line)
+		al.size += int64(n)
+		if err != nil {
+			al.logger.Errorf("Failed to write to access log '%s': %s", al.config.Path, err)
+		}
+	}
+}
+
+// rotate shifts the backups by one, dropping the oldest, and starts a new file. If Path can't
+// be shifted, it is reopened to keep logging, and the error returned.
+func (al *accessLog) rotate() error {
+	if al.file != nil {
+		al.file.Close()
+		al.file = nil
+	}
+	for i := al.config.MaxBackups - 1; i > 0; i-- {
+		os.Rename(fmt.Sprintf("%s.%d", al.config.Path, i), fmt.Sprintf("%s.%d", al.config.Path, i+1))
+	}
+	renameErr := os.Rename(al.config.Path, al.config.Path+".1")
+	if err := al.open(); err != nil {
+		return err
+	}
+	return renameErr
+}
+
+func (al *accessLog) open() error {
+	file, err := os.OpenFile(al.config.Path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	al.file = file
+	al.size = info.Size()
+	return nil
+}
+
+func newAccessLog(logger xlog.Logger, config AccessLogConfig) (*accessLog, error) {
+	if config.Path == "" {
+		return nil, errors.New("AccessLogConfig.Path must be set")
+	}
+	if config.Format != AccessLogText && config.Format != AccessLogJSON {
+		return nil, errors.New("AccessLogConfig.Format must be AccessLogText or AccessLogJSON")
+	}
+	if config.MaxSize < 0 || config.MaxBackups < 0 {
+		return nil, errors.New("AccessLogConfig.MaxSize and MaxBackups must be >=0")
+	}
+	if config.SampleRate < 0 || config.SampleRate > 1 {
+		return nil, errors.New("AccessLogConfig.SampleRate must be in (0, 1]")
+	}
+	if config.MaxSize == 0 {
+		config.MaxSize = DefaultAccessLogMaxSize
+	}
+	if config.MaxBackups == 0 {
+		config.MaxBackups = DefaultAccessLogMaxBackups
+	}
+	if config.SampleRate == 0 {
+		config.SampleRate = 1
+	}
+	al := &accessLog{
+		logger: logger,
+		config: config,
+		ch:     make(chan *accessLogEntry, accessLogBufferSize),
+		rnd:    rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+	if err := al.open(); err != nil {
+		return nil, err
+	}
+	go al.writeLoop()
+	return al, nil
+}
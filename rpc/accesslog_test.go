@@ -0,0 +1,213 @@
+package rpc_test
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/xinlaini/golibs/rpc"
+)
+
+// startAccessLogServer serves a Log service, whose Fail method fails, with the access log
+// config. It returns a client of the service.
+func startAccessLogServer(t *testing.T, config *rpc.AccessLogConfig) (*countingListener, *rpc.Client) {
+	l, opts := startCountingServer(t, rpc.Config{
+		Services: map[string]rpc.ServiceConfig{
+			"Log": {Raw: func(ctx *rpc.ServerContext, requestPB []byte) ([]byte, error) {
+				if ctx.Metadata.GetMethodName() == "Fail" {
+					return nil, errors.New("failed on purpose")
+				}
+				return requestPB, nil
+			}},
+		},
+		AccessLog: config,
+	}, "Log")
+	return l, newClient(t, opts)
+}
+
+// readLines waits until the file at path exists with n lines, and returns them.
+func readLines(t *testing.T, path string, n int) []string {
+	var lines []string
+	waitFor(t, "access log lines", func() bool {
+		data, err := ioutil.ReadFile(path)
+		if err != nil && !os.IsNotExist(err) {
+			t.Fatal(err)
+		}
+		lines = strings.Split(strings.TrimSuffix(string(data), "\n"), "\n")
+		return len(data) > 0 && len(lines) >= n
+	})
+	return lines
+}
+
+func TestAccessLog(t *testing.T) {
+	dir, err := ioutil.TempDir("", "accesslog")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, format := range []rpc.AccessLogFormat{rpc.AccessLogText, rpc.AccessLogJSON} {
+		path := filepath.Join(dir, "access.log")
+		os.Remove(path)
+		l, c := startAccessLogServer(t, &rpc.AccessLogConfig{Path: path, Format: format})
+		if _, err := call(c, nil, "Get", "a"); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := call(c, nil, "Fail", "a"); err == nil {
+			t.Error("Fail succeeded")
+		}
+		c.Close()
+		l.Close()
+
+		lines := readLines(t, path, 2)
+		if format == rpc.AccessLogText {
+			if !strings.Contains(lines[0], " Log.Get OK ") {
+				t.Errorf("Got text line %q for Get", lines[0])
+			}
+			if !strings.Contains(lines[1], ` Log.Fail ERROR `) || !strings.Contains(lines[1], "failed on purpose") {
+				t.Errorf("Got text line %q for Fail", lines[1])
+			}
+			continue
+		}
+		var entries [2]struct {
+			Method string `json:"method"`
+			Status string `json:"status"`
+			Error  string `json:"error"`
+		}
+		for i := range entries {
+			if err := json.Unmarshal([]byte(lines[i]), &entries[i]); err != nil {
+				t.Fatalf("Failed to decode JSON line %q: %s", lines[i], err)
+			}
+		}
+		if entries[0].Method != "Get" || entries[0].Status != "OK" || entries[0].Error != "" {
+			t.Errorf("Got JSON entry %+v for Get", entries[0])
+		}
+		if entries[1].Method != "Fail" || entries[1].Status != "ERROR" ||
+			!strings.Contains(entries[1].Error, "failed on purpose") {
+			t.Errorf("Got JSON entry %+v for Fail", entries[1])
+		}
+	}
+}
+
+func TestAccessLogRotation(t *testing.T) {
+	dir, err := ioutil.TempDir("", "accesslog")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "access.log")
+
+	// Every line exceeds MaxSize, so each one goes to a new file.
+	l, c := startAccessLogServer(t, &rpc.AccessLogConfig{Path: path, MaxSize: 1, MaxBackups: 2})
+	defer l.Close()
+	defer c.Close()
+	for i := 0; i < 4; i++ {
+		if _, err := call(c, nil, "Get", "a"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, name := range []string{path + ".2", path + ".1", path} {
+		if lines := readLines(t, name, 1); len(lines) != 1 {
+			t.Errorf("%s has %d lines, want 1", name, len(lines))
+		}
+	}
+	if _, err := os.Stat(path + ".3"); !os.IsNotExist(err) {
+		t.Errorf("Got %s beyond MaxBackups (error: %v)", path+".3", err)
+	}
+}
+
+func TestAccessLogSampling(t *testing.T) {
+	dir, err := ioutil.TempDir("", "accesslog")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "access.log")
+
+	// Practically no success is sampled, failures are always logged.
+	l, c := startAccessLogServer(t, &rpc.AccessLogConfig{Path: path, SampleRate: 1e-9})
+	defer l.Close()
+	defer c.Close()
+	for _, methodName := range []string{"Get", "Get", "Fail"} {
+		call(c, nil, methodName, "a")
+	}
+	lines := readLines(t, path, 1)
+	if len(lines) != 1 || !strings.Contains(lines[0], " Log.Fail ERROR ") {
+		t.Errorf("Got lines %q, want only Fail", lines)
+	}
+}
+
+func TestAccessLogRotationFailure(t *testing.T) {
+	dir, err := ioutil.TempDir("", "accesslog")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "access.log")
+	// A non-empty directory in the way of the backup fails every rotation.
+	if err = os.MkdirAll(filepath.Join(path+".1", "blocker"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	l, c := startAccessLogServer(t, &rpc.AccessLogConfig{Path: path, MaxSize: 1, MaxBackups: 1})
+	defer l.Close()
+	defer c.Close()
+	for i := 0; i < 3; i++ {
+		if _, err := call(c, nil, "Get", "a"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Lines keep going to path.
+	if lines := readLines(t, path, 3); len(lines) != 3 {
+		t.Errorf("%s has %d lines, want 3", path, len(lines))
+	}
+}
+
+func TestAccessLogRejectedRequests(t *testing.T) {
+	dir, err := ioutil.TempDir("", "accesslog")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "access.log")
+	l, c := startAccessLogServer(t, &rpc.AccessLogConfig{Path: path})
+	defer l.Close()
+	c.Close()
+
+	// A legacy client sends a frame which isn't a request.
+	conn, err := l.Dial("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	payload := []byte("not a request")
+	frame := make([]byte, 4, 4+len(payload))
+	binary.BigEndian.PutUint32(frame, uint32(len(payload)))
+	if _, err = conn.Write(append(frame, payload...)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = io.ReadFull(conn, frame[:4]); err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+	// Another starts with neither the handshake nor a plausible frame size.
+	if conn, err = l.Dial(""); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = conn.Write([]byte{0xff, 0xff, 0xff, 0xff}); err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+
+	lines := readLines(t, path, 2)
+	for i, want := range []string{"Failed to unmarshal request", "not speaking the RPC protocol"} {
+		if !strings.Contains(lines[i], " - ERROR ") || !strings.Contains(lines[i], want) {
+			t.Errorf("Got line %q for a rejected request, want an error with %q", lines[i], want)
+		}
+	}
+}
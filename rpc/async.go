@@ -0,0 +1,122 @@
+package rpc
+
+import (
+	"log"
+	"reflect"
+
+	"golang.org/x/net/context"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/xinlaini/golibs/log"
+)
+
+// AsyncCall is an RPC started by Client.Go.
+type AsyncCall struct {
+	MethodName string
+	Ctx        *ClientContext
+	Request    proto.Message
+	// Response and Error are set once the call completes.
+	Response proto.Message
+	Error    error
+	// Done receives the call once it completes.
+	Done chan *AsyncCall
+
+	// finished is closed once the call completes, independently of Done which may be shared.
+	finished chan struct{}
+}
+
+// Finished returns a channel closed once the call completes.
+func (call *AsyncCall) Finished() <-chan struct{} {
+	return call.finished
+}
+
+func (call *AsyncCall) finish(logger xlog.Logger) {
+	close(call.finished)
+	// Never block the caller, as net/rpc does.
+	select {
+	case call.Done <- call:
+	default:
+		logger.Errorf(
+			"Discarding completed call of method '%s' due to insufficient Done chan capacity",
+			call.MethodName)
+	}
+}
+
+// Go starts calling methodName in the background, and sends the call to done once it
+// completes. If done is nil, a new channel is allocated, otherwise it must be buffered so that
+// calls can complete without a receiver. Several calls may share a done channel.
+func (c *Client) Go(
+	methodName string,
+	ctx *ClientContext,
+	requestPB proto.Message,
+	responseType reflect.Type,
+	done chan *AsyncCall) *AsyncCall {
+	if done == nil {
+		done = make(chan *AsyncCall, 1)
+	} else if cap(done) == 0 {
+		log.Panic("Client.Go: done channel is unbuffered")
+	}
+	call := &AsyncCall{
+		MethodName: methodName,
+		Ctx:        ctx,
+		Request:    requestPB,
+		Done:       done,
+		finished:   make(chan struct{}),
+	}
+	go func() {
+		call.Response, call.Error = c.Call(methodName, ctx, requestPB, responseType)
+		call.finish(c.logger)
+	}()
+	return call
+}
+
+// WaitAll waits for all calls to complete, or for ctx to be done. It returns an error only in
+// the latter case, the errors of the calls are in their Error fields.
+func WaitAll(ctx context.Context, calls ...*AsyncCall) error {
+	for _, call := range calls {
+		select {
+		case <-call.finished:
+		case <-ctx.Done():
+			return makeClientErr(ctx.Err().Error())
+		}
+	}
+	return nil
+}
+
+// WaitFirst waits for the first n calls to succeed, and returns them in completion order. It
+// fails with the successful calls so far if ctx is done, or once too many calls failed for n of
+// them to succeed.
+func WaitFirst(ctx context.Context, n int, calls ...*AsyncCall) ([]*AsyncCall, error) {
+	if n > len(calls) {
+		return nil, makeClientErrf("Cannot wait for %d of %d calls", n, len(calls))
+	}
+	// Buffered so that the forwarders never outlive their calls.
+	completed := make(chan *AsyncCall, len(calls))
+	for _, call := range calls {
+		go func(call *AsyncCall) {
+			<-call.finished
+			completed <- call
+		}(call)
+	}
+
+	succeeded := make([]*AsyncCall, 0, n)
+	failed := 0
+	for len(succeeded) < n {
+		select {
+		case call := <-completed:
+			if call.Error != nil {
+				failed++
+				if len(calls)-failed < n {
+					return succeeded, makeClientErrf(
+						"%d of %d calls failed, cannot wait for %d, last error: %s",
+						failed, len(calls), n, call.Error)
+				}
+			} else {
+				succeeded = append(succeeded, call)
+			}
+		case <-ctx.Done():
+			return succeeded, makeClientErr(ctx.Err().Error())
+		}
+	}
+	return succeeded, nil
+}
@@ -0,0 +1,145 @@
+package rpc_test
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"gen/pb/rpc/rpc_proto"
+
+	"github.com/golang/protobuf/proto"
+	"golang.org/x/net/context"
+
+	"github.com/xinlaini/golibs/log"
+	"github.com/xinlaini/golibs/rpc"
+)
+
+// errorLogger records the errors logged.
+type errorLogger struct {
+	xlog.Logger
+	errors []string
+	mtx    sync.Mutex
+}
+
+func (l *errorLogger) Errorf(format string, v ...interface{}) {
+	l.mtx.Lock()
+	l.errors = append(l.errors, fmt.Sprintf(format, v...))
+	l.mtx.Unlock()
+}
+
+func (l *errorLogger) logged(substr string) bool {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	for _, err := range l.errors {
+		if strings.Contains(err, substr) {
+			return true
+		}
+	}
+	return false
+}
+
+// startSleepServer serves a Sleep method which sleeps for the duration in its request, or
+// fails if it doesn't parse.
+func startSleepServer(t *testing.T) (*countingListener, rpc.ClientOptions) {
+	return startCountingServer(t, rpc.Config{
+		Services: map[string]rpc.ServiceConfig{
+			"Sleep": {Raw: func(ctx *rpc.ServerContext, requestPB []byte) ([]byte, error) {
+				request := &rpc_proto.KeyValue{}
+				if err := proto.Unmarshal(requestPB, request); err != nil {
+					return nil, err
+				}
+				d, err := time.ParseDuration(request.GetValue())
+				if err != nil {
+					return nil, err
+				}
+				time.Sleep(d)
+				return requestPB, nil
+			}},
+		},
+	}, "Sleep")
+}
+
+func goSleep(c *rpc.Client, d string, done chan *rpc.AsyncCall) *rpc.AsyncCall {
+	return c.Go("Sleep", &rpc.ClientContext{Context: context.Background()}, kv(d), kvType, done)
+}
+
+func TestGo(t *testing.T) {
+	l, opts := startSleepServer(t)
+	defer l.Close()
+	opts.ConnPoolSize = 4
+	c := newClient(t, opts)
+	defer c.Close()
+
+	done := make(chan *rpc.AsyncCall, 4)
+	calls := []*rpc.AsyncCall{
+		goSleep(c, "100ms", done),
+		goSleep(c, "0s", done),
+		goSleep(c, "bad", done),
+		goSleep(c, "20ms", done),
+	}
+	first, err := rpc.WaitFirst(context.Background(), 2, calls...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(first) != 2 || first[0] != calls[1] || first[1] != calls[3] {
+		t.Errorf("WaitFirst() returned calls of %v, %v", first[0].Request, first[1].Request)
+	}
+	if err := rpc.WaitAll(context.Background(), calls...); err != nil {
+		t.Fatal(err)
+	}
+	for range calls {
+		call := <-done
+		if (call.Error != nil) != (call == calls[2]) {
+			t.Errorf("Call of %v failed with %v", call.Request, call.Error)
+		}
+	}
+	if _, err := rpc.WaitFirst(context.Background(), 4, calls...); err == nil {
+		t.Error("WaitFirst() for more calls than succeeded succeeded")
+	}
+	if _, err := rpc.WaitFirst(context.Background(), 5, calls...); err == nil {
+		t.Error("WaitFirst() for more calls than given succeeded")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	slow := goSleep(c, "100ms", nil)
+	if err := rpc.WaitAll(ctx, slow); err == nil {
+		t.Error("WaitAll() returned before the slow call completed")
+	}
+	if call := <-slow.Done; call != slow || call.Error != nil {
+		t.Errorf("Slow call completed with %v", call.Error)
+	}
+}
+
+func TestGoDoneCapacity(t *testing.T) {
+	l, opts := startSleepServer(t)
+	defer l.Close()
+	logger := &errorLogger{Logger: xlog.NewNilLogger()}
+	ctrl, err := rpc.NewController(rpc.Config{Logger: logger})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := ctrl.NewClient(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	done := make(chan *rpc.AsyncCall, 1)
+	calls := []*rpc.AsyncCall{goSleep(c, "0s", done), goSleep(c, "0s", done)}
+	if err := rpc.WaitAll(context.Background(), calls...); err != nil {
+		t.Fatal(err)
+	}
+	if !logger.logged("insufficient Done chan capacity") {
+		t.Error("Discarding a completed call wasn't logged")
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Error("Go() with an unbuffered done channel didn't panic")
+		}
+	}()
+	goSleep(c, "0s", make(chan *rpc.AsyncCall))
+}
@@ -0,0 +1,175 @@
+package rpc
+
+import (
+	"net"
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"gen/pb/rpc/rpc_proto"
+
+	"github.com/golang/protobuf/proto"
+)
+
+const (
+	DefaultMaxBatchSize        = 1000
+	DefaultMaxBatchConcurrency = 16
+)
+
+// BatchEntry is one call of a batch sent by Client.CallBatch.
+type BatchEntry struct {
+	MethodName   string
+	Request      proto.Message
+	ResponseType reflect.Type
+	// RequestHeader and IdempotencyKey are as in ClientContext.
+	RequestHeader  MD
+	IdempotencyKey string
+
+	// The fields below are set once the batch completes.
+	Response        proto.Message
+	Error           error
+	Metadata        *rpc_proto.ResponseMetadata
+	ResponseHeader  MD
+	ResponseTrailer MD
+}
+
+// CallBatch sends all entries in one frame, to be run by the server one after another if
+// ordered, or concurrently otherwise. It fails only if the batch as a whole fails, e.g. on a
+// network error, the outcome of each call is in its entry.
+//
+// Unlike Call, the entries bypass the client side response cache, fault injection, mirroring
+// and binary log, which all work on single calls. The server handles each entry as a call of
+// its own, though.
+func (c *Client) CallBatch(ctx *ClientContext, entries []*BatchEntry, ordered bool) error {
+	if len(entries) == 0 {
+		return nil
+	}
+	batch := c.newRequest("", ctx, nil, 0)
+	batch.BatchOrdered = proto.Bool(ordered)
+	entryCtxs := make([]*ClientContext, len(entries))
+	for i, entry := range entries {
+		var requestPBBytes []byte
+		if entry.Request != nil && !reflect.ValueOf(entry.Request).IsNil() {
+			var err error
+			if requestPBBytes, err = proto.Marshal(entry.Request); err != nil {
+				return makeClientErrf("Failed to marshal request of batch entry %d: %s", i, err)
+			}
+		}
+		entryCtxs[i] = &ClientContext{
+			Context:        ctx.Context,
+			Priority:       ctx.Priority,
+			RequestHeader:  entry.RequestHeader,
+			IdempotencyKey: entry.IdempotencyKey,
+		}
+		batch.Batch = append(batch.Batch, c.newRequest(entry.MethodName, entryCtxs[i], requestPBBytes, 0))
+	}
+
+	response, rtt, err := c.roundtripRequest(ctx, batch, false)
+	if err != nil {
+		return err
+	}
+	ctx.RoundTripTime = rtt
+	if _, err = ctx.setResponse(response); err != nil {
+		return err
+	}
+	if len(response.Batch) != len(entries) {
+		return makeClientErrf("Got %d batch responses, want %d", len(response.Batch), len(entries))
+	}
+
+	for i, entry := range entries {
+		entryCtx := entryCtxs[i]
+		entryCtx.RoundTripTime = rtt
+		var responsePBBytes []byte
+		responsePBBytes, entry.Error = entryCtx.setResponse(response.Batch[i])
+		entry.Metadata = entryCtx.Metadata
+		entry.ResponseHeader = entryCtx.ResponseHeader
+		entry.ResponseTrailer = entryCtx.ResponseTrailer
+		entry.Response = nil
+		if entry.Error != nil || responsePBBytes == nil {
+			continue
+		}
+		responsePB := reflect.New(entry.ResponseType).Interface().(proto.Message)
+		if err = proto.Unmarshal(responsePBBytes, responsePB); err != nil {
+			entry.Error = makeClientErrf("Failed to unmarshal method response: %s", err)
+			continue
+		}
+		entry.Response = responsePB
+	}
+	return nil
+}
+
+// serveBatch runs the calls of a batch request, in order or concurrently as requested. It
+// returns nil if the connection should be dropped.
+func (svr *server) serveBatch(
+	conn net.Conn,
+	batch *rpc_proto.Request,
+	received time.Time,
+	allowed map[string]bool) *rpc_proto.Response {
+	response := svr.newResponse()
+	if len(batch.Batch) > svr.maxBatchSize {
+		response.Error = makeServerErrf(
+			"Batch has %d calls, more than the %d allowed", len(batch.Batch), svr.maxBatchSize)
+		return response
+	}
+	response.Batch = make([]*rpc_proto.Response, len(batch.Batch))
+	// The calls share the deadline of the batch, so that ordered calls don't each get the whole
+	// of it.
+	var deadline time.Time
+	if timeoutUs := batch.GetMetadata().GetTimeoutUs(); timeoutUs > 0 {
+		deadline = received.Add(time.Duration(timeoutUs) * time.Microsecond)
+	}
+	serveEntry := func(i int) {
+		request := batch.Batch[i]
+		if len(request.Batch) > 0 {
+			response.Batch[i] = svr.newResponse()
+			response.Batch[i].Error = makeServerErr("Batches cannot be nested")
+			return
+		}
+		if !deadline.IsZero() && request.Metadata != nil {
+			remaining := deadline.Sub(time.Now())
+			if remaining < time.Microsecond {
+				response.Batch[i] = svr.newResponse()
+				response.Batch[i].Error = makeServerErr("Batch deadline exceeded before the call started")
+				return
+			}
+			request.Metadata.TimeoutUs = proto.Int64(int64(remaining / time.Microsecond))
+		}
+		response.Batch[i], _ = svr.dispatch(conn, request, received, allowed)
+	}
+
+	if batch.GetBatchOrdered() {
+		for i := range batch.Batch {
+			if serveEntry(i); response.Batch[i] == nil {
+				return nil
+			}
+		}
+		return response
+	}
+	// A few workers take the calls in turn, so that a batch can't start any number of
+	// goroutines.
+	workers := svr.maxBatchConcurrency
+	if workers > len(batch.Batch) {
+		workers = len(batch.Batch)
+	}
+	var (
+		next int32 = -1
+		wg   sync.WaitGroup
+	)
+	wg.Add(workers)
+	for w := 0; w < workers; w++ {
+		go func() {
+			defer wg.Done()
+			for i := int(atomic.AddInt32(&next, 1)); i < len(batch.Batch); i = int(atomic.AddInt32(&next, 1)) {
+				serveEntry(i)
+			}
+		}()
+	}
+	wg.Wait()
+	for _, entryResponse := range response.Batch {
+		if entryResponse == nil {
+			return nil
+		}
+	}
+	return response
+}
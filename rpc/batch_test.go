@@ -0,0 +1,209 @@
+package rpc_test
+
+import (
+	"errors"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"gen/pb/rpc/rpc_proto"
+
+	"golang.org/x/net/context"
+
+	"github.com/xinlaini/golibs/rpc"
+)
+
+func batchEntry(methodName, value string) *rpc.BatchEntry {
+	return &rpc.BatchEntry{
+		MethodName:    methodName,
+		Request:       kv(value),
+		ResponseType:  kvType,
+		RequestHeader: rpc.MD{"value": value},
+	}
+}
+
+func TestCallBatch(t *testing.T) {
+	var (
+		order []string
+		mtx   sync.Mutex
+	)
+	s, c := startPipeServer(t, rpc.Config{
+		Services: map[string]rpc.ServiceConfig{
+			"Batch": {Raw: func(ctx *rpc.ServerContext, requestPB []byte) ([]byte, error) {
+				mtx.Lock()
+				order = append(order, ctx.RequestHeader["value"])
+				mtx.Unlock()
+				if ctx.Metadata.GetMethodName() == "Fail" {
+					return nil, errors.New("Failed")
+				}
+				ctx.ResponseHeader["value"] = ctx.RequestHeader["value"]
+				return requestPB, nil
+			}},
+		},
+	}, "Batch")
+	defer s.Close()
+	defer c.Close()
+
+	for _, ordered := range []bool{true, false} {
+		order = nil
+		entries := []*rpc.BatchEntry{
+			batchEntry("Get", "a"),
+			batchEntry("Fail", "b"),
+			batchEntry("Get", "c"),
+		}
+		ctx, cancel := newCtx()
+		err := c.CallBatch(ctx, entries, ordered)
+		cancel()
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i, entry := range entries {
+			if (entry.Error != nil) != (i == 1) {
+				t.Errorf("Entry %d failed with %v", i, entry.Error)
+			}
+			if i == 1 {
+				continue
+			}
+			value := entry.RequestHeader["value"]
+			if got := entry.Response.(*rpc_proto.KeyValue).GetValue(); got != value {
+				t.Errorf("Entry %d got response %q, want %q", i, got, value)
+			}
+			if got := entry.ResponseHeader["value"]; got != value {
+				t.Errorf("Entry %d got response header %q, want %q", i, got, value)
+			}
+		}
+		if ordered && strings.Join(order, "") != "abc" {
+			t.Errorf("Ordered batch ran in order %v", order)
+		}
+		if len(order) != 3 {
+			t.Errorf("Batch ran %d calls, want 3", len(order))
+		}
+	}
+
+	ctx, cancel := newCtx()
+	defer cancel()
+	if err := c.CallBatch(ctx, nil, true); err != nil {
+		t.Errorf("Empty batch failed with %v", err)
+	}
+}
+
+func TestCallBatchConcurrently(t *testing.T) {
+	const size = 3
+	var inFlight sync.WaitGroup
+	inFlight.Add(size)
+	s, c := startPipeServer(t, rpc.Config{
+		Services: map[string]rpc.ServiceConfig{
+			"Batch": {Raw: func(ctx *rpc.ServerContext, requestPB []byte) ([]byte, error) {
+				inFlight.Done()
+				inFlight.Wait()
+				return requestPB, nil
+			}},
+		},
+	}, "Batch")
+	defer s.Close()
+	defer c.Close()
+
+	var entries []*rpc.BatchEntry
+	for i := 0; i < size; i++ {
+		entries = append(entries, batchEntry("Get", "a"))
+	}
+	ctx, cancel := newCtx()
+	defer cancel()
+	if err := c.CallBatch(ctx, entries, false); err != nil {
+		t.Fatal(err)
+	}
+	for i, entry := range entries {
+		if entry.Error != nil {
+			t.Errorf("Entry %d failed with %v", i, entry.Error)
+		}
+	}
+}
+
+func TestCallBatchSharesDeadline(t *testing.T) {
+	const (
+		timeout = time.Second
+		sleep   = 50 * time.Millisecond
+	)
+	remaining := make(chan time.Duration, 3)
+	s, c := startPipeServer(t, rpc.Config{
+		Services: map[string]rpc.ServiceConfig{
+			"Batch": {Raw: func(ctx *rpc.ServerContext, requestPB []byte) ([]byte, error) {
+				deadline, _ := ctx.Deadline()
+				remaining <- time.Until(deadline)
+				time.Sleep(sleep)
+				return requestPB, nil
+			}},
+		},
+	}, "Batch")
+	defer s.Close()
+	defer c.Close()
+
+	entries := []*rpc.BatchEntry{batchEntry("Get", "a"), batchEntry("Get", "b"), batchEntry("Get", "c")}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	if err := c.CallBatch(&rpc.ClientContext{Context: ctx}, entries, true); err != nil {
+		t.Fatal(err)
+	}
+	for i := range entries {
+		if got, max := <-remaining, timeout-time.Duration(i)*sleep; got > max {
+			t.Errorf("Entry %d started with %s left, want at most %s", i, got, max)
+		}
+	}
+}
+
+func TestCallBatchLimits(t *testing.T) {
+	const maxConcurrency = 2
+	var (
+		started, running, maxRunning int32
+		barrier                      sync.WaitGroup
+	)
+	barrier.Add(maxConcurrency)
+	s, c := startPipeServer(t, rpc.Config{
+		Services: map[string]rpc.ServiceConfig{
+			"Batch": {Raw: func(ctx *rpc.ServerContext, requestPB []byte) ([]byte, error) {
+				n := atomic.AddInt32(&running, 1)
+				defer atomic.AddInt32(&running, -1)
+				for max := atomic.LoadInt32(&maxRunning); n > max; max = atomic.LoadInt32(&maxRunning) {
+					if atomic.CompareAndSwapInt32(&maxRunning, max, n) {
+						break
+					}
+				}
+				// The first calls wait for each other, so that the others would overlap them.
+				if atomic.AddInt32(&started, 1) <= maxConcurrency {
+					barrier.Done()
+					barrier.Wait()
+				}
+				return requestPB, nil
+			}},
+		},
+		MaxBatchSize:        5,
+		MaxBatchConcurrency: maxConcurrency,
+	}, "Batch")
+	defer s.Close()
+	defer c.Close()
+
+	var entries []*rpc.BatchEntry
+	for i := 0; i < 5; i++ {
+		entries = append(entries, batchEntry("Get", "a"))
+	}
+	ctx, cancel := newCtx()
+	defer cancel()
+	if err := c.CallBatch(ctx, entries, false); err != nil {
+		t.Fatal(err)
+	}
+	for i, entry := range entries {
+		if entry.Error != nil {
+			t.Errorf("Entry %d failed with %v", i, entry.Error)
+		}
+	}
+	if n := atomic.LoadInt32(&maxRunning); n != maxConcurrency {
+		t.Errorf("Ran up to %d calls of the batch at once, want %d", n, maxConcurrency)
+	}
+
+	entries = append(entries, batchEntry("Get", "a"))
+	if err := c.CallBatch(ctx, entries, false); err == nil || !strings.Contains(err.Error(), "more than the 5 allowed") {
+		t.Errorf("Batch beyond MaxBatchSize failed with %v", err)
+	}
+}
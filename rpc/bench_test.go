@@ -0,0 +1,131 @@
+package rpc_test
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"testing"
+
+	"gen/pb/rpc/rpc_proto"
+
+	"golang.org/x/net/context"
+
+	"github.com/xinlaini/golibs/rpc"
+	"github.com/xinlaini/golibs/rpc/rpctest"
+)
+
+var (
+	benchPayloadSizes = []int{64, 4 << 10, 64 << 10}
+	benchResponseType = reflect.TypeOf(rpc_proto.Request{})
+)
+
+// startEchoServer serves a raw Echo service on loopback TCP, and returns a client with
+// poolSize connections to it.
+func startEchoServer(b *testing.B, poolSize int) (*rpctest.Server, *rpc.Client) {
+	s, err := rpctest.StartServer(rpc.Config{
+		Services: map[string]rpc.ServiceConfig{
+			"Echo": {Raw: func(ctx *rpc.ServerContext, requestPB []byte) ([]byte, error) {
+				return requestPB, nil
+			}},
+		},
+	})
+	if err != nil {
+		b.Fatal(err)
+	}
+	opts := s.ClientOptions("Echo")
+	opts.ConnPoolSize = poolSize
+	c, err := s.Controller.NewClient(opts)
+	if err != nil {
+		s.Close()
+		b.Fatal(err)
+	}
+	return s, c
+}
+
+func echo(c *rpc.Client, request *rpc_proto.Request) error {
+	response, err := c.Call("Echo", &rpc.ClientContext{Context: context.Background()}, request, benchResponseType)
+	if err != nil {
+		return err
+	}
+	if len(response.(*rpc_proto.Request).RequestPb) != len(request.RequestPb) {
+		return errors.New("Echoed payload differs in size")
+	}
+	return nil
+}
+
+// BenchmarkCall measures sequential calls over one connection. Run with -benchmem to see the
+// allocations per call, which drive the GC load.
+func BenchmarkCall(b *testing.B) {
+	for _, size := range benchPayloadSizes {
+		b.Run(fmt.Sprintf("%dB", size), func(b *testing.B) {
+			s, c := startEchoServer(b, 1)
+			defer s.Close()
+			defer c.Close()
+			request := &rpc_proto.Request{RequestPb: make([]byte, size)}
+
+			b.SetBytes(int64(size))
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if err := echo(c, request); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+// BenchmarkCallParallel measures concurrent calls over a pool of connections.
+func BenchmarkCallParallel(b *testing.B) {
+	for _, size := range benchPayloadSizes {
+		b.Run(fmt.Sprintf("%dB", size), func(b *testing.B) {
+			s, c := startEchoServer(b, 8)
+			defer s.Close()
+			defer c.Close()
+			request := &rpc_proto.Request{RequestPb: make([]byte, size)}
+
+			b.SetBytes(int64(size))
+			b.ReportAllocs()
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					if err := echo(c, request); err != nil {
+						b.Error(err)
+						return
+					}
+				}
+			})
+		})
+	}
+}
+
+// maxCallAllocs pins the allocations of a call of a raw method over a pipe, counting both the
+// client and the server, to catch regressions on the request path. Calls take 46 now, the rest
+// is slack for runtime noise. It's averaged over many more calls than the rings of recent calls
+// hold, as frames only go back to their pool once evicted.
+const maxCallAllocs = 50
+
+// raceEnabled is set when built with -race, which adds allocations of its own.
+var raceEnabled bool
+
+func TestCallAllocs(t *testing.T) {
+	if raceEnabled {
+		t.Skip("Allocations are not representative with -race")
+	}
+	s, c := startPipeServer(t, rpc.Config{
+		Services: map[string]rpc.ServiceConfig{"Echo": echoService()},
+	}, "Echo")
+	defer s.Close()
+	defer c.Close()
+	request := &rpc_proto.Request{RequestPb: make([]byte, 4<<10)}
+
+	allocs := testing.AllocsPerRun(1000, func() {
+		if err := echo(c, request); err != nil {
+			t.Fatal(err)
+		}
+	})
+	t.Logf("%v allocs per call", allocs)
+	if allocs > maxCallAllocs {
+		t.Errorf("Got %v allocs per call, want at most %d", allocs, maxCallAllocs)
+	}
+}
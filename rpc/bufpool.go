@@ -0,0 +1,134 @@
+package rpc
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+
+	"github.com/golang/protobuf/proto"
+)
+
+const (
+	// maxPooledFrameSize keeps the buffers of unusually large frames out of the pool, so that
+	// it doesn't pin their memory. Reading larger frames also grows the buffer with the data
+	// received, rather than trusting the size prefix up front.
+	maxPooledFrameSize = 1 << 20
+)
+
+var (
+	framePool = sync.Pool{
+		New: func() interface{} {
+			return &frame{}
+		},
+	}
+)
+
+// frame is a pooled buffer holding one length-prefixed frame: the 4-byte size followed by the
+// payload. Frames are written with their checksum, if enabled, in one vectored write.
+type frame struct {
+	buf      []byte
+	checksum [4]byte
+	pb       proto.Buffer
+	vec      [2][]byte
+	bufs     net.Buffers
+	// refs counts the holders of the frame, which goes back to the pool once they all put it.
+	refs int32
+}
+
+func getFrame() *frame {
+	f := framePool.Get().(*frame)
+	f.refs = 1
+	return f
+}
+
+// retain adds a holder to f, which must put it when done.
+func (f *frame) retain() {
+	atomic.AddInt32(&f.refs, 1)
+}
+
+// putFrame drops a reference to f, and returns it to the pool if it was the last one. Nothing
+// may reference its buffer afterwards.
+func putFrame(f *frame) {
+	if atomic.AddInt32(&f.refs, -1) > 0 {
+		return
+	}
+	if cap(f.buf) > maxPooledFrameSize {
+		f.buf = nil
+	}
+	framePool.Put(f)
+}
+
+func (f *frame) payload() []byte {
+	return f.buf[4:]
+}
+
+// marshal encodes msg as the payload of f, right after room for the size.
+func (f *frame) marshal(msg proto.Message) error {
+	f.pb.SetBuf(append(f.buf[:0], 0, 0, 0, 0))
+	err := f.pb.Marshal(msg)
+	f.buf = f.pb.Bytes()
+	f.pb.SetBuf(nil)
+	if err != nil {
+		return err
+	}
+	binary.BigEndian.PutUint32(f.buf, uint32(len(f.buf)-4))
+	return nil
+}
+
+// write writes f to w, followed by the checksum of its payload if enabled.
+func (f *frame) write(w io.Writer, checksums bool) error {
+	f.vec[0] = f.buf
+	f.bufs = f.vec[:1]
+	if checksums {
+		binary.BigEndian.PutUint32(f.checksum[:], crc32.Checksum(f.payload(), crc32cTable))
+		f.vec[1] = f.checksum[:]
+		f.bufs = f.vec[:2]
+	}
+	_, err := f.bufs.WriteTo(w)
+	f.vec[0], f.vec[1], f.bufs = nil, nil, nil
+	return err
+}
+
+// readSize reads the size of the next frame from r.
+func (f *frame) readSize(r io.Reader) (uint32, error) {
+	if cap(f.buf) < 4 {
+		f.buf = make([]byte, 4, 512)
+	}
+	f.buf = f.buf[:4]
+	if _, err := io.ReadFull(r, f.buf); err != nil {
+		return 0, err
+	}
+	return binary.BigEndian.Uint32(f.buf), nil
+}
+
+// readPayload reads the payload of the frame whose size was just read from r.
+func (f *frame) readPayload(r io.Reader, size uint32) error {
+	n := 4 + int(size)
+	if n > maxPooledFrameSize {
+		buf := bytes.NewBuffer(f.buf[:4])
+		_, err := io.CopyN(buf, r, int64(size))
+		f.buf = buf.Bytes()
+		return err
+	}
+	if cap(f.buf) < n {
+		buf := make([]byte, n)
+		copy(buf, f.buf[:4])
+		f.buf = buf
+	}
+	f.buf = f.buf[:n]
+	_, err := io.ReadFull(r, f.buf[4:])
+	return err
+}
+
+// verifyChecksum reads the checksum following the payload from r, and reports whether it
+// matches.
+func (f *frame) verifyChecksum(r io.Reader) (bool, error) {
+	if _, err := io.ReadFull(r, f.checksum[:]); err != nil {
+		return false, err
+	}
+	return binary.BigEndian.Uint32(f.checksum[:]) == crc32.Checksum(f.payload(), crc32cTable), nil
+}
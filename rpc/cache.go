@@ -0,0 +1,114 @@
+package rpc
+
+import (
+	"bytes"
+	"container/list"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"gen/pb/rpc/rpc_proto"
+
+	"github.com/golang/protobuf/proto"
+)
+
+type cacheEntry struct {
+	key       string
+	response  *rpc_proto.Response
+	expiresAt time.Time
+	elem      *list.Element
+}
+
+// responseCache holds up to size successful responses that the server marked cacheable, each
+// until its max-age, capped by maxTTL if >0, runs out. The least recently used entries are
+// evicted first.
+type responseCache struct {
+	size    int
+	maxTTL  time.Duration
+	entries map[string]*cacheEntry
+	// lru orders entries from least to most recently used.
+	lru *list.List
+	mtx sync.Mutex
+}
+
+// responseCacheKey identifies a call by all it sends: method, flags, request header and
+// payload. Header entries are sorted and quoted, so that equal headers make equal keys and
+// distinct ones can't run together.
+func responseCacheKey(methodName string, flags uint32, header MD, requestPB []byte) string {
+	keys := make([]string, 0, len(header))
+	for key := range header {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	buf := &bytes.Buffer{}
+	fmt.Fprintf(buf, "%s/%d/", methodName, flags)
+	for _, key := range keys {
+		fmt.Fprintf(buf, "%q:%q,", key, header[key])
+	}
+	buf.WriteByte('/')
+	buf.Write(requestPB)
+	return buf.String()
+}
+
+// get returns a copy of the cached response for key, or nil.
+func (cache *responseCache) get(key string, now time.Time) *rpc_proto.Response {
+	cache.mtx.Lock()
+	defer cache.mtx.Unlock()
+	entry, found := cache.entries[key]
+	if !found {
+		return nil
+	}
+	if !now.Before(entry.expiresAt) {
+		cache.remove(entry)
+		return nil
+	}
+	cache.lru.MoveToBack(entry.elem)
+	return proto.Clone(entry.response).(*rpc_proto.Response)
+}
+
+// put caches response under key if it succeeded and the server allows it.
+func (cache *responseCache) put(key string, response *rpc_proto.Response, now time.Time) {
+	if response.Error != nil {
+		return
+	}
+	ttl := time.Duration(response.GetMetadata().GetCacheMaxAgeUs()) * time.Microsecond
+	if cache.maxTTL > 0 && ttl > cache.maxTTL {
+		ttl = cache.maxTTL
+	}
+	if ttl <= 0 {
+		return
+	}
+
+	cache.mtx.Lock()
+	defer cache.mtx.Unlock()
+	if entry, found := cache.entries[key]; found {
+		cache.remove(entry)
+	}
+	entry := &cacheEntry{
+		key:       key,
+		response:  proto.Clone(response).(*rpc_proto.Response),
+		expiresAt: now.Add(ttl),
+	}
+	entry.elem = cache.lru.PushBack(entry)
+	cache.entries[key] = entry
+	for cache.lru.Len() > cache.size {
+		cache.remove(cache.lru.Front().Value.(*cacheEntry))
+	}
+}
+
+// remove drops entry. mtx must be held.
+func (cache *responseCache) remove(entry *cacheEntry) {
+	cache.lru.Remove(entry.elem)
+	delete(cache.entries, entry.key)
+}
+
+func newResponseCache(size int, maxTTL time.Duration) *responseCache {
+	return &responseCache{
+		size:    size,
+		maxTTL:  maxTTL,
+		entries: make(map[string]*cacheEntry),
+		lru:     list.New(),
+	}
+}
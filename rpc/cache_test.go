@@ -0,0 +1,138 @@
+package rpc_test
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"gen/pb/rpc/rpc_proto"
+
+	"github.com/golang/protobuf/proto"
+
+	"github.com/xinlaini/golibs/rpc"
+)
+
+// startCacheServer serves a Get method whose responses are cacheable unless the method is
+// Uncached, and reflect the request and its "locale" header. It counts the calls it serves.
+func startCacheServer(t *testing.T, served *int32) (*countingListener, rpc.ClientOptions) {
+	return startCountingServer(t, rpc.Config{
+		Services: map[string]rpc.ServiceConfig{
+			"Cache": {Raw: func(ctx *rpc.ServerContext, requestPB []byte) ([]byte, error) {
+				atomic.AddInt32(served, 1)
+				if ctx.Metadata.GetMethodName() != "Uncached" {
+					ctx.CacheMaxAge = time.Minute
+				}
+				request := &rpc_proto.KeyValue{}
+				if err := proto.Unmarshal(requestPB, request); err != nil {
+					return nil, err
+				}
+				return proto.Marshal(kv(request.GetValue() + "/" + ctx.RequestHeader["locale"]))
+			}},
+		},
+	}, "Cache")
+}
+
+// cachedCall calls methodName with value and header, and returns the response and whether it
+// came from the cache.
+func cachedCall(t *testing.T, c *rpc.Client, methodName, value string, header rpc.MD, bypass bool) (string, bool) {
+	ctx, cancel := newCtx()
+	defer cancel()
+	ctx.RequestHeader = header
+	ctx.BypassCache = bypass
+	got, err := call(c, ctx, methodName, value)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return got, ctx.CacheHit
+}
+
+func TestResponseCache(t *testing.T) {
+	var served int32
+	l, opts := startCacheServer(t, &served)
+	defer l.Close()
+	opts.ResponseCacheSize = 2
+	c := newClient(t, opts)
+	defer c.Close()
+
+	for _, test := range []struct {
+		methodName string
+		value      string
+		bypass     bool
+		wantHit    bool
+	}{
+		{"Get", "a", false, false},
+		{"Get", "a", false, true},
+		// Bypassing refreshes the cache.
+		{"Get", "a", true, false},
+		{"Get", "a", false, true},
+		{"Uncached", "a", false, false},
+		{"Uncached", "a", false, false},
+		{"Get", "b", false, false},
+		// Evicts "a", the least recently used.
+		{"Get", "c", false, false},
+		{"Get", "b", false, true},
+		{"Get", "a", false, false},
+	} {
+		got, hit := cachedCall(t, c, test.methodName, test.value, nil, test.bypass)
+		if got != test.value+"/" {
+			t.Errorf("%s(%q) = %q", test.methodName, test.value, got)
+		}
+		if hit != test.wantHit {
+			t.Errorf("%s(%q) with bypass %t has CacheHit %t", test.methodName, test.value, test.bypass, hit)
+		}
+	}
+	if n := atomic.LoadInt32(&served); n != 7 {
+		t.Errorf("Server served %d calls, want 7", n)
+	}
+}
+
+func TestResponseCacheKeysOnHeader(t *testing.T) {
+	var served int32
+	l, opts := startCacheServer(t, &served)
+	defer l.Close()
+	opts.ResponseCacheSize = 10
+	c := newClient(t, opts)
+	defer c.Close()
+
+	for _, test := range []struct {
+		header  rpc.MD
+		want    string
+		wantHit bool
+	}{
+		{rpc.MD{"locale": "en"}, "a/en", false},
+		{rpc.MD{"locale": "fr"}, "a/fr", false},
+		{nil, "a/", false},
+		{rpc.MD{"locale": "en"}, "a/en", true},
+		{rpc.MD{"locale": "en", "tenant": "t1"}, "a/en", false},
+		{rpc.MD{"tenant": "t1", "locale": "en"}, "a/en", true},
+		{rpc.MD{"locale": "fr"}, "a/fr", true},
+	} {
+		got, hit := cachedCall(t, c, "Get", "a", test.header, false)
+		if got != test.want || hit != test.wantHit {
+			t.Errorf("Get with header %v = %q, CacheHit %t, want %q, %t", test.header, got, hit, test.want, test.wantHit)
+		}
+	}
+}
+
+func TestResponseCacheMaxTTL(t *testing.T) {
+	var served int32
+	l, opts := startCacheServer(t, &served)
+	defer l.Close()
+	opts.ResponseCacheSize = 10
+	opts.ResponseCacheMaxTTL = 20 * time.Millisecond
+	c := newClient(t, opts)
+	defer c.Close()
+
+	start := time.Now()
+	cachedCall(t, c, "Get", "a", nil, false)
+	if _, hit := cachedCall(t, c, "Get", "a", nil, false); !hit {
+		t.Error("Response wasn't cached")
+	}
+	waitFor(t, "the cached response to expire", func() bool {
+		_, hit := cachedCall(t, c, "Get", "a", nil, false)
+		return !hit
+	})
+	if elapsed := time.Since(start); elapsed < opts.ResponseCacheMaxTTL {
+		t.Errorf("Cached response expired after %s, before ResponseCacheMaxTTL", elapsed)
+	}
+}
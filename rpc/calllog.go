@@ -0,0 +1,85 @@
+package rpc
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+const (
+	binaryLogBufferSize = 256
+)
+
+// loggedCall holds a reference to the request and response frames of a call, and the parts of
+// them to log: the request frame, the response size and the response payload.
+type loggedCall struct {
+	frames [2]*frame
+	data   [3][]byte
+}
+
+func (lc loggedCall) retain() {
+	for _, f := range lc.frames {
+		if f != nil {
+			f.retain()
+		}
+	}
+}
+
+func (lc loggedCall) release() {
+	for _, f := range lc.frames {
+		if f != nil {
+			putFrame(f)
+		}
+	}
+}
+
+// callLog keeps the most recent calls, and hands calls to the binary log if enabled. It holds
+// references to the frames of the calls rather than copies, so a frame goes back to its pool
+// once its call is evicted from the ring and written to the binary log.
+type callLog struct {
+	recentCalls []loggedCall
+	next        int
+	mtx         sync.Mutex
+	// ch feeds the binary log, nil if disabled.
+	ch chan loggedCall
+	// dropped counts the calls not logged because the binary log fell behind.
+	dropped int64
+}
+
+// record logs a call with the given frames, which it references until done with them. The
+// binary log drops the call if it fell behind, so that calls never wait for the disk.
+func (cl *callLog) record(request, response *frame, data [3][]byte) {
+	call := loggedCall{frames: [2]*frame{request, response}, data: data}
+	call.retain()
+	cl.mtx.Lock()
+	evicted := cl.recentCalls[cl.next]
+	cl.recentCalls[cl.next] = call
+	cl.next = (cl.next + 1) % len(cl.recentCalls)
+	cl.mtx.Unlock()
+	evicted.release()
+
+	if cl.ch == nil {
+		return
+	}
+	call.retain()
+	select {
+	case cl.ch <- call:
+	default:
+		call.release()
+		atomic.AddInt64(&cl.dropped, 1)
+	}
+}
+
+// takeDropped returns the calls dropped since the last time, for the binary log to report.
+func (cl *callLog) takeDropped() int64 {
+	return atomic.SwapInt64(&cl.dropped, 0)
+}
+
+func newCallLog(size int, binaryLog bool) *callLog {
+	cl := &callLog{
+		recentCalls: make([]loggedCall, size),
+	}
+	if binaryLog {
+		cl.ch = make(chan loggedCall, binaryLogBufferSize)
+	}
+	return cl
+}
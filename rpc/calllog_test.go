@@ -0,0 +1,76 @@
+package rpc
+
+import (
+	"testing"
+)
+
+func newTestFrame(payload string) *frame {
+	f := getFrame()
+	f.buf = append(f.buf[:0], 0, 0, 0, 0)
+	f.buf = append(f.buf, payload...)
+	return f
+}
+
+func loggedFrames(f *frame) [3][]byte {
+	return [3][]byte{f.buf, f.buf[:4], f.payload()}
+}
+
+func TestCallLogRecentCalls(t *testing.T) {
+	cl := newCallLog(2, false)
+	request, response := newTestFrame("request"), newTestFrame("response")
+	cl.record(request, response, loggedFrames(request))
+	putFrame(request)
+	putFrame(response)
+
+	// The ring keeps the frames after the call is done, until the call is evicted.
+	if request.refs != 1 || response.refs != 1 {
+		t.Errorf("Frames have %d and %d references in the ring, want 1", request.refs, response.refs)
+	}
+	if got := string(cl.recentCalls[0].frames[0].payload()); got != "request" {
+		t.Errorf("Recent call has request %q, want \"request\"", got)
+	}
+	for i := 0; i < 2; i++ {
+		f := newTestFrame("other")
+		cl.record(f, f, loggedFrames(f))
+		putFrame(f)
+	}
+	if request.refs != 0 || response.refs != 0 {
+		t.Errorf("Frames have %d and %d references once evicted, want 0", request.refs, response.refs)
+	}
+}
+
+func TestCallLogBinaryLog(t *testing.T) {
+	cl := newCallLog(1, true)
+	request, response := newTestFrame("request"), newTestFrame("response")
+	cl.record(request, response, loggedFrames(request))
+	putFrame(request)
+	putFrame(response)
+	// A later call evicts this one from the ring, but the binary log still holds its frames.
+	f := newTestFrame("other")
+	cl.record(f, f, loggedFrames(f))
+	putFrame(f)
+
+	logged := <-cl.ch
+	if got := string(logged.data[2]); got != "request" {
+		t.Errorf("Logged payload %q, want \"request\"", got)
+	}
+	if request.refs != 1 {
+		t.Errorf("Logged frame has %d references, want 1", request.refs)
+	}
+	logged.release()
+	if request.refs != 0 || response.refs != 0 {
+		t.Errorf("Frames have %d and %d references once logged, want 0", request.refs, response.refs)
+	}
+	<-cl.ch
+
+	// Once the binary log falls behind, calls are dropped instead of waiting.
+	for i := 0; i < binaryLogBufferSize+3; i++ {
+		cl.record(f, f, loggedFrames(f))
+	}
+	if dropped := cl.takeDropped(); dropped != 3 {
+		t.Errorf("Dropped %d calls, want 3", dropped)
+	}
+	if dropped := cl.takeDropped(); dropped != 0 {
+		t.Errorf("Dropped %d calls after taking the count, want 0", dropped)
+	}
+}
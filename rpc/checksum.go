@@ -0,0 +1,16 @@
+package rpc
+
+import (
+	"hash/crc32"
+)
+
+// On connections that negotiated CapChecksums, every frame with a payload is followed by the
+// CRC32C of its payload, 4 bytes big-endian. Pings stay empty frames without a checksum.
+
+var (
+	crc32cTable = crc32.MakeTable(crc32.Castagnoli)
+
+	// ErrChecksumMismatch is returned by calls whose response frame is corrupted. The
+	// connection is discarded.
+	ErrChecksumMismatch = makeClientErr("Frame checksum mismatch")
+)
@@ -0,0 +1,94 @@
+package rpc_test
+
+import (
+	"net"
+	"sync/atomic"
+	"testing"
+
+	"github.com/xinlaini/golibs/log"
+	"github.com/xinlaini/golibs/rpc"
+)
+
+// corruptingConn flips the last byte of the next frame read or written once armed. Frames are
+// told apart from sizes and checksums by being longer than 4 bytes.
+type corruptingConn struct {
+	net.Conn
+	corruptRead  *int32
+	corruptWrite *int32
+}
+
+func (conn *corruptingConn) Read(b []byte) (int, error) {
+	n, err := conn.Conn.Read(b)
+	if n > 4 && atomic.CompareAndSwapInt32(conn.corruptRead, 1, 0) {
+		b[n-1] ^= 0xff
+	}
+	return n, err
+}
+
+func (conn *corruptingConn) Write(b []byte) (int, error) {
+	if len(b) > 4 && atomic.CompareAndSwapInt32(conn.corruptWrite, 1, 0) {
+		b = append([]byte(nil), b...)
+		b[len(b)-1] ^= 0xff
+	}
+	return conn.Conn.Write(b)
+}
+
+func TestFrameChecksums(t *testing.T) {
+	l, opts := startCountingServer(t, rpc.Config{
+		Services: map[string]rpc.ServiceConfig{"Echo": echoService()},
+	}, "Echo")
+	defer l.Close()
+	var corruptRead, corruptWrite int32
+	opts.Dial = func(addr string) (net.Conn, error) {
+		conn, err := l.Dial(addr)
+		if err != nil {
+			return nil, err
+		}
+		return &corruptingConn{Conn: conn, corruptRead: &corruptRead, corruptWrite: &corruptWrite}, nil
+	}
+	opts.FrameChecksums = true
+	c := newClient(t, opts)
+	defer c.Close()
+
+	if got, err := call(c, nil, "Get", "a"); err != nil || got != "a" {
+		t.Fatalf("Got %q (error: %v), want \"a\"", got, err)
+	}
+
+	// A corrupted response fails the call, and its connection is replaced.
+	atomic.StoreInt32(&corruptRead, 1)
+	if _, err := call(c, nil, "Get", "a"); err != rpc.ErrChecksumMismatch {
+		t.Errorf("Call with a corrupted response failed with %v, want %v", err, rpc.ErrChecksumMismatch)
+	}
+	if got, err := call(c, nil, "Get", "a"); err != nil || got != "a" {
+		t.Errorf("Got %q (error: %v) after a corrupted response, want \"a\"", got, err)
+	}
+
+	// The server drops the connection of a corrupted request.
+	atomic.StoreInt32(&corruptWrite, 1)
+	if _, err := call(c, nil, "Get", "a"); err == nil {
+		t.Error("Call with a corrupted request succeeded")
+	}
+	if got, err := call(c, nil, "Get", "a"); err != nil || got != "a" {
+		t.Errorf("Got %q (error: %v) after a corrupted request, want \"a\"", got, err)
+	}
+	if got := l.numAccepted(); got != 3 {
+		t.Errorf("Server accepted %d connections, want 3", got)
+	}
+}
+
+func TestFrameChecksumsRequireHandshake(t *testing.T) {
+	ctrl, err := rpc.NewController(rpc.Config{Logger: xlog.NewNilLogger()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = ctrl.NewClient(rpc.ClientOptions{
+		ServiceName:    "Echo",
+		ServiceAddr:    "localhost:1",
+		ConnPoolSize:   1,
+		Handshake:      rpc.HandshakeOff,
+		FrameChecksums: true,
+	})
+	if err == nil {
+		t.Error("NewClient accepted FrameChecksums without the handshake")
+	}
+}
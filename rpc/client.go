@@ -1,12 +1,10 @@
 package rpc
 
 import (
-	"bytes"
-	"encoding/binary"
 	"errors"
 	"fmt"
-	"io"
 	"log"
+	"math/rand"
 	"net"
 	"os"
 	"path/filepath"
@@ -22,6 +20,8 @@ import (
 
 const (
 	recentEgressCount = 64
+
+	DefaultMaxConnectionAgeJitter = 0.1
 )
 
 var (
@@ -38,11 +38,51 @@ type DialRetryPolicy struct {
 	MaxSleep time.Duration
 }
 
+// DialFunc establishes a new connection to addr. A nil DialFunc dials TCP.
+type DialFunc func(addr string) (net.Conn, error)
+
 type ClientOptions struct {
-	ServiceName  string
-	ServiceAddr  string
+	ServiceName string
+	ServiceAddr string
+	// ConnPoolSize connections are opened eagerly and kept open.
 	ConnPoolSize int
-	Retry        DialRetryPolicy
+	// MaxConnPoolSize lets the pool grow on demand when calls wait for a free connection.
+	// Defaults to ConnPoolSize, i.e. a fixed pool.
+	MaxConnPoolSize int
+	// PoolShrinkIdleTime closes connections beyond ConnPoolSize idle for longer. 0 keeps
+	// them open.
+	PoolShrinkIdleTime time.Duration
+	Retry              DialRetryPolicy
+	Dial               DialFunc
+	// KeepaliveInterval is how often idle pooled connections are pinged, 0 disables pings.
+	KeepaliveInterval time.Duration
+	// KeepaliveTimeout bounds each ping, defaults to DefaultKeepaliveTimeout.
+	KeepaliveTimeout time.Duration
+	// MaxIdleTime closes pooled connections idle for longer and dials fresh ones in their place,
+	// for networks that silently drop idle connections. Unlike PoolShrinkIdleTime, it keeps the
+	// pool size, fixed or not. 0 disables it.
+	MaxIdleTime time.Duration
+	// MaxConnectionAge closes and replaces pooled connections older than this after their
+	// current call, so that the pool re-resolves and rebalances over time. 0 disables it.
+	MaxConnectionAge time.Duration
+	// MaxConnectionAgeJitter randomizes MaxConnectionAge per connection by up to this fraction
+	// either way, so that connections created together don't expire together. Defaults to
+	// DefaultMaxConnectionAgeJitter, a negative value disables jitter.
+	MaxConnectionAgeJitter float64
+	// ResponseCacheSize bounds the number of responses cached by the client, 0 disables the
+	// cache. Only responses the server marks cacheable are cached, for their max-age.
+	ResponseCacheSize int
+	// ResponseCacheMaxTTL caps the max-age of cached responses, 0 leaves it to the server.
+	ResponseCacheMaxTTL time.Duration
+	// Mirror, if set, copies a fraction of the calls to a shadow backend.
+	Mirror *MirrorOptions
+	// Handshake is how connections negotiate the protocol with the server, HandshakeAuto by
+	// default. HandshakeTimeout defaults to DefaultHandshakeTimeout.
+	Handshake        HandshakeMode
+	HandshakeTimeout time.Duration
+	// FrameChecksums offers the server a CRC32C checksum on every frame, to detect corruption
+	// in transit. It requires the handshake, and is off on legacy connections.
+	FrameChecksums bool
 }
 
 type connEntry struct {
@@ -50,23 +90,52 @@ type connEntry struct {
 	localPort      string
 	connectedSince time.Time
 	idleSince      time.Time
+	pingedSince    time.Time
+	// Zero if the connection never expires.
+	expiresAt time.Time
+	// caps are the capabilities negotiated by the handshake, none for the legacy protocol.
+	caps Capabilities
 }
 
 type Client struct {
 	logger      xlog.Logger
 	serviceName string
 	serviceAddr string
-
-	entries         map[string]*connEntry
-	mtxEntries      sync.RWMutex
-	freeConns       chan *connEntry
-	shouldConnect   chan struct{}
-	closed          chan struct{}
-	connectLoopDone chan struct{}
-	logLoopDone     chan struct{}
-	chLog           chan [3][]byte
-	recentCalls     [recentEgressCount][3][]byte
-	mtxRecentCalls  sync.RWMutex
+	dial        DialFunc
+
+	entries          map[string]*connEntry
+	mtxEntries       sync.RWMutex
+	freeConns        chan *connEntry
+	shouldConnect    chan struct{}
+	closed           chan struct{}
+	connectLoopDone  chan struct{}
+	maintainLoopDone chan struct{}
+	logLoopDone      chan struct{}
+	calls            *callLog
+
+	minPoolSize int
+	maxPoolSize int
+	// poolSize counts established connections and those being dialed.
+	poolSize int
+	stats    ClientStats
+	mtxPool  sync.Mutex
+
+	state        ConnectivityState
+	stateChanged chan struct{}
+	mtxState     sync.Mutex
+
+	handshakeMode    HandshakeMode
+	handshakeTimeout time.Duration
+	// legacyPeers are the servers found not to handshake, shared by all Clients.
+	legacyPeers *legacyPeerSet
+	// caps are the capabilities offered in handshakes.
+	caps Capabilities
+
+	// cache is nil if disabled.
+	cache  *responseCache
+	faults *faultInjector
+	// mirror is nil if disabled.
+	mirror *mirror
 }
 
 func (c *Client) Call(
@@ -120,8 +189,10 @@ func (c *Client) CallWithTextPB(methodName string, ctx *ClientContext, requestPB
 }
 
 func (c *Client) Close() {
+	c.setState(Shutdown)
 	close(c.closed)
 	<-c.connectLoopDone
+	<-c.maintainLoopDone
 	<-c.logLoopDone
 
 	// Close all the connections.
@@ -132,98 +203,168 @@ func (c *Client) Close() {
 	}
 	c.mtxEntries.Unlock()
 
+	if c.mirror != nil {
+		c.mirror.close()
+	}
 	c.logger.Infof("Client for '%s' to '%s' is closed", c.serviceName, c.serviceAddr)
 }
 
 func (c *Client) callInternal(methodName string, ctx *ClientContext, requestPB []byte, flags uint32) ([]byte, error) {
+	ctx.CacheHit = false
+	var cacheKey string
+	if c.cache != nil {
+		cacheKey = responseCacheKey(methodName, flags, ctx.RequestHeader, requestPB)
+		if !ctx.BypassCache {
+			if response := c.cache.get(cacheKey, time.Now()); response != nil {
+				ctx.CacheHit = true
+				ctx.RoundTripTime = 0
+				return ctx.setResponse(response)
+			}
+		}
+	}
+
+	request := c.newRequest(methodName, ctx, requestPB, flags)
+	err := c.faults.inject(ctx, true, request.Metadata)
+	drop := err == errFaultDropped
+	if err != nil && !drop {
+		if ctx.Err() != nil {
+			return nil, makeClientErr(err.Error())
+		}
+		return nil, err
+	}
+	response, rtt, err := c.roundtripRequest(ctx, request, drop)
+	if err != nil {
+		return nil, err
+	}
+	if c.cache != nil {
+		c.cache.put(cacheKey, response, time.Now())
+	}
+	ctx.RoundTripTime = rtt
+	responsePB, err := ctx.setResponse(response)
+	if c.mirror != nil {
+		c.mirror.start(methodName, ctx, requestPB, flags, responsePB, err)
+	}
+	return responsePB, err
+}
+
+func (c *Client) newRequest(methodName string, ctx *ClientContext, requestPB []byte, flags uint32) *rpc_proto.Request {
 	request := &rpc_proto.Request{
 		Metadata: &rpc_proto.RequestMetadata{
 			ClientJobName:   proto.String(os.Args[0]),
-			ClientRequestId: proto.String(fmt.Sprintf("%x", time.Now().UnixNano())),
+			ClientRequestId: proto.String(newRequestID()),
 			ServiceName:     proto.String(c.serviceName),
 			MethodName:      proto.String(methodName),
 			Flags:           proto.Uint32(flags),
+			Headers:         mdToPB(ctx.RequestHeader),
 		},
 		RequestPb: requestPB,
 	}
-	// Propagate the deadline, if one is set.
+	if ctx.IdempotencyKey != "" {
+		request.Metadata.IdempotencyKey = proto.String(ctx.IdempotencyKey)
+	}
+	if ctx.Priority != PriorityNormal {
+		request.Metadata.Priority = proto.Int32(int32(ctx.Priority))
+	}
+	// Propagate the deadline, if one is set. TimeoutUs is in microseconds, as servers have
+	// always read it; older clients sent nanoseconds.
 	deadline, ok := ctx.Deadline()
 	if ok {
-		request.Metadata.TimeoutUs = proto.Int64(int64(deadline.Sub(time.Now())))
+		request.Metadata.TimeoutUs = proto.Int64(int64(deadline.Sub(time.Now()) / time.Microsecond))
 	}
-	requestBytes, err := proto.Marshal(request)
+	return request
+}
+
+// roundtripRequest sends request in one frame and returns the response along with the round
+// trip time. If drop is set, the connection of the call is dropped by fault injection instead.
+func (c *Client) roundtripRequest(
+	ctx *ClientContext, request *rpc_proto.Request, drop bool) (*rpc_proto.Response, time.Duration, error) {
+	requestFrame := getFrame()
+	defer putFrame(requestFrame)
+	if err := requestFrame.marshal(request); err != nil {
+		return nil, 0, makeClientErrf("Failed to marshal RPC request: %s", err)
+	}
+	responseFrame := getFrame()
+	defer putFrame(responseFrame)
+	rtt, err := c.runNetIO(ctx, requestFrame, responseFrame, drop)
 	if err != nil {
-		return nil, makeClientErrf("Failed to marshal RPC request: %s", err)
-	}
-	requestSize := make([]byte, 4)
-	binary.BigEndian.PutUint32(requestSize, uint32(len(requestBytes)))
-	responseBytes, err := c.runNetIO(ctx, requestSize, requestBytes)
-	if err != nil {
-		return nil, err
+		return nil, 0, err
 	}
 
-	go c.log(requestSize, requestBytes, responseBytes)
+	c.calls.record(requestFrame, responseFrame, [3][]byte{
+		requestFrame.buf[:4], requestFrame.payload(), responseFrame.buf})
 
 	response := &rpc_proto.Response{}
-	if err = proto.Unmarshal(responseBytes[4:], response); err != nil {
-		return nil, makeClientErrf("Failed to unmarshal RPC response: %s", err)
-	}
-	ctx.Metadata = response.Metadata
-	if response.Error != nil {
-		// Copy the response error verbatim.
-		return nil, errors.New(response.GetError())
+	if err = proto.Unmarshal(responseFrame.payload(), response); err != nil {
+		return nil, 0, makeClientErrf("Failed to unmarshal RPC response: %s", err)
 	}
-	return response.ResponsePb, nil
+	return response, rtt, nil
 }
 
-func (c *Client) log(requestSize, requestBytes, responseBytes []byte) {
-	c.chLog <- [3][]byte{requestSize, requestBytes, responseBytes}
+// runNetIO sends the request over a pooled connection and reads the response, returning the
+// round trip time, excluding the wait for a free connection. If drop is set, it discards the
+// connection as if it broke instead.
+func (c *Client) runNetIO(ctx *ClientContext, request, response *frame, drop bool) (time.Duration, error) {
+	entry, err := c.acquire(ctx)
+	if err != nil {
+		return 0, err
+	}
+	if drop {
+		c.logger.Infof(
+			"Dropping connection from local port '%s' to '%s' by fault injection",
+			entry.localPort, c.serviceAddr)
+		c.discard(entry)
+		return 0, makeClientErr(errFaultDropped.Error())
+	}
+	start := time.Now()
+	err = roundtrip(ctx, entry.conn, entry.caps&CapChecksums != 0, request, response)
+	rtt := time.Now().Sub(start)
+	if err != nil {
+		// Connection is not reusable, must discard.
+		c.logger.Errorf(
+			"Connection from local port '%s' to '%s' is unreusable (error: %s), discarding...",
+			entry.localPort,
+			c.serviceAddr,
+			err)
+		c.discard(entry)
+	} else if entry.expired(time.Now()) {
+		c.logger.Infof(
+			"Connection from local port '%s' to '%s' reached its max age, rotating...",
+			entry.localPort, c.serviceAddr)
+		c.discard(entry)
+	} else {
+		// No error, push the connection back to the pool.
+		c.mtxEntries.Lock()
+		entry.idleSince = time.Now()
+		c.mtxEntries.Unlock()
+
+		c.freeConns <- entry
+	}
+	return rtt, err
 }
 
-func (c *Client) runNetIO(ctx *ClientContext, requestSize, requestBytes []byte) ([]byte, error) {
-	select {
-	case <-c.closed:
-		return nil, makeClientErr("Client is closed")
-	case <-ctx.Done():
-		return nil, makeClientErr(ctx.Err().Error())
-	case entry := <-c.freeConns:
-		responseBytes, err := roundtrip(ctx, entry.conn, requestSize, requestBytes)
-		if err != nil {
-			// Connection is not reusable, must discard.
-			c.logger.Errorf(
-				"Connection from local port '%s' to '%s' is unreusable (error: %s), discarding...",
-				entry.localPort,
-				c.serviceAddr,
-				err)
-			entry.conn.Close()
-
-			c.mtxEntries.Lock()
-			delete(c.entries, entry.localPort)
-			c.mtxEntries.Unlock()
+// discard closes the connection of entry and asks connectLoop for a replacement.
+func (c *Client) discard(entry *connEntry) {
+	entry.conn.Close()
 
-			// Signal connectLoop to re-establish a new connection.
-			c.shouldConnect <- struct{}{}
-		} else {
-			// No error, push the connection back to the pool.
-			c.mtxEntries.Lock()
-			entry.idleSince = time.Now()
-			c.mtxEntries.Unlock()
+	c.mtxEntries.Lock()
+	delete(c.entries, entry.localPort)
+	c.mtxEntries.Unlock()
+	c.setStateIfNoConn(Connecting)
 
-			c.freeConns <- entry
-		}
-		return responseBytes, err
-	}
+	// Signal connectLoop to re-establish a new connection.
+	c.shouldConnect <- struct{}{}
 }
 
 func (c *Client) connectWithRetry(opts *ClientOptions) *connEntry {
 	// Retry loop for one connection.
 	sleep := opts.Retry.Sleep
 	for {
-		conn, err := net.Dial("tcp", c.serviceAddr)
+		conn, caps, err := c.dialProtocol()
 		if err != nil {
 			c.logger.Errorf(
 				"Failed to dial to '%s' (error: %s), will retry after %s",
 				c.serviceAddr, err, sleep.String())
+			c.setStateIfNoConn(TransientFailure)
 			select {
 			case <-c.closed:
 				return nil
@@ -243,10 +384,23 @@ func (c *Client) connectWithRetry(opts *ClientOptions) *connEntry {
 			localPort:      localPort,
 			connectedSince: now,
 			idleSince:      now,
+			pingedSince:    now,
+			caps:           caps,
+			expiresAt:      connExpiry(opts, now),
 		}
 	}
 }
 
+// connExpiry returns when a connection established at now reaches its jittered max age, zero
+// if it never does.
+func connExpiry(opts *ClientOptions, now time.Time) time.Time {
+	if opts.MaxConnectionAge == 0 {
+		return time.Time{}
+	}
+	jitter := (2*rand.Float64() - 1) * opts.MaxConnectionAgeJitter
+	return now.Add(time.Duration(float64(opts.MaxConnectionAge) * (1 + jitter)))
+}
+
 func (c *Client) connectLoop(opts *ClientOptions) {
 	defer c.logger.Infof("Quitting connectLoop for remote address '%s'", c.serviceAddr)
 
@@ -266,6 +420,7 @@ func (c *Client) connectLoop(opts *ClientOptions) {
 			}
 			c.entries[entry.localPort] = entry
 			c.mtxEntries.Unlock()
+			c.setState(Ready)
 
 			// Make this entry available for consumption.
 			c.freeConns <- entry
@@ -287,7 +442,6 @@ func (c *Client) logLoop(binaryLogDir, serviceName string) {
 		}
 	}
 
-	next := 0
 	for {
 		select {
 		case <-c.closed:
@@ -296,14 +450,13 @@ func (c *Client) logLoop(binaryLogDir, serviceName string) {
 				binaryLog.Close()
 			}
 			return
-		case data := <-c.chLog:
-			c.mtxRecentCalls.Lock()
-			c.recentCalls[next] = data
-			c.mtxRecentCalls.Unlock()
-			next = (next + 1) % recentEgressCount
+		case call := <-c.calls.ch:
+			if dropped := c.calls.takeDropped(); dropped > 0 {
+				c.logger.Errorf("Dropped %d calls from the binary log, writing fell behind", dropped)
+			}
 			if binaryLog != nil {
 				for i := 0; i < 3; i++ {
-					if _, err := binaryLog.Write(data[i]); err != nil {
+					if _, err := binaryLog.Write(call.data[i]); err != nil {
 						c.logger.Errorf(
 							"Failed to write to '%s', it's now closed and may be compromised: %s",
 							binaryLog.Name(), err)
@@ -313,13 +466,27 @@ func (c *Client) logLoop(binaryLogDir, serviceName string) {
 					}
 				}
 			}
+			call.release()
 		}
 	}
 }
 
+func (entry *connEntry) expired(now time.Time) bool {
+	return !entry.expiresAt.IsZero() && now.After(entry.expiresAt)
+}
+
 func validateOpts(opts *ClientOptions) error {
-	if opts.ConnPoolSize <= 0 {
-		return errors.New("ClientOptions.ConnPoolSize must be >0")
+	if opts.ConnPoolSize < 0 {
+		return errors.New("ClientOptions.ConnPoolSize must be >=0")
+	}
+	if opts.MaxConnPoolSize == 0 && opts.ConnPoolSize == 0 {
+		return errors.New("ClientOptions.ConnPoolSize must be >0 unless MaxConnPoolSize is set")
+	}
+	if opts.MaxConnPoolSize != 0 && opts.MaxConnPoolSize < opts.ConnPoolSize {
+		return errors.New("ClientOptions.MaxConnPoolSize must be >= ConnPoolSize")
+	}
+	if opts.PoolShrinkIdleTime < 0 {
+		return errors.New("ClientOptions.PoolShrinkIdleTime must be >=0")
 	}
 	if opts.Retry.Sleep <= 0 {
 		return errors.New("ClientOptions.Retry.Sleep must be >0")
@@ -330,6 +497,27 @@ func validateOpts(opts *ClientOptions) error {
 	if opts.Retry.MaxSleep < opts.Retry.Sleep {
 		return errors.New("ClientOptions.Retry.MaxSleep must be > Sleep")
 	}
+	if opts.KeepaliveInterval < 0 || opts.KeepaliveTimeout < 0 || opts.MaxIdleTime < 0 {
+		return errors.New("ClientOptions.KeepaliveInterval, KeepaliveTimeout and MaxIdleTime must be >=0")
+	}
+	if opts.MaxConnectionAge < 0 {
+		return errors.New("ClientOptions.MaxConnectionAge must be >=0")
+	}
+	if opts.MaxConnectionAgeJitter >= 1 {
+		return errors.New("ClientOptions.MaxConnectionAgeJitter must be <1")
+	}
+	if opts.Handshake < HandshakeAuto || opts.Handshake > HandshakeOff {
+		return errors.New("ClientOptions.Handshake is invalid")
+	}
+	if opts.HandshakeTimeout < 0 {
+		return errors.New("ClientOptions.HandshakeTimeout must be >=0")
+	}
+	if opts.FrameChecksums && opts.Handshake == HandshakeOff {
+		return errors.New("ClientOptions.FrameChecksums requires the handshake")
+	}
+	if opts.ResponseCacheSize < 0 || opts.ResponseCacheMaxTTL < 0 {
+		return errors.New("ClientOptions.ResponseCacheSize and ResponseCacheMaxTTL must be >=0")
+	}
 	return nil
 }
 
@@ -337,17 +525,60 @@ func newClient(ctrl *Controller, opts *ClientOptions) (*Client, error) {
 	if err := validateOpts(opts); err != nil {
 		return nil, err
 	}
+	if opts.KeepaliveTimeout == 0 {
+		opts.KeepaliveTimeout = DefaultKeepaliveTimeout
+	}
+	if opts.MaxConnectionAgeJitter == 0 {
+		opts.MaxConnectionAgeJitter = DefaultMaxConnectionAgeJitter
+	} else if opts.MaxConnectionAgeJitter < 0 {
+		opts.MaxConnectionAgeJitter = 0
+	}
+	if opts.MaxConnPoolSize == 0 {
+		opts.MaxConnPoolSize = opts.ConnPoolSize
+	}
+	if opts.HandshakeTimeout == 0 {
+		opts.HandshakeTimeout = DefaultHandshakeTimeout
+	}
 	c := &Client{
-		logger:          ctrl.logger,
-		serviceName:     opts.ServiceName,
-		serviceAddr:     opts.ServiceAddr,
-		entries:         make(map[string]*connEntry),
-		freeConns:       make(chan *connEntry, opts.ConnPoolSize),
-		shouldConnect:   make(chan struct{}, opts.ConnPoolSize),
-		closed:          make(chan struct{}),
-		connectLoopDone: make(chan struct{}),
-		logLoopDone:     make(chan struct{}),
-		chLog:           make(chan [3][]byte),
+		logger:           ctrl.logger,
+		serviceName:      opts.ServiceName,
+		serviceAddr:      opts.ServiceAddr,
+		dial:             opts.Dial,
+		handshakeMode:    opts.Handshake,
+		handshakeTimeout: opts.HandshakeTimeout,
+		legacyPeers:      legacyPeers,
+		faults:           ctrl.faults,
+		entries:          make(map[string]*connEntry),
+		freeConns:        make(chan *connEntry, opts.MaxConnPoolSize),
+		shouldConnect:    make(chan struct{}, opts.MaxConnPoolSize),
+		minPoolSize:      opts.ConnPoolSize,
+		maxPoolSize:      opts.MaxConnPoolSize,
+		poolSize:         opts.ConnPoolSize,
+		closed:           make(chan struct{}),
+		connectLoopDone:  make(chan struct{}),
+		maintainLoopDone: make(chan struct{}),
+		logLoopDone:      make(chan struct{}),
+		calls:            newCallLog(recentEgressCount, ctrl.binaryLogDir != ""),
+		state:            Connecting,
+		stateChanged:     make(chan struct{}),
+	}
+	if opts.ConnPoolSize == 0 {
+		c.state = Idle
+	}
+	if c.dial == nil {
+		c.dial = dialTCP
+	}
+	if opts.FrameChecksums {
+		c.caps |= CapChecksums
+	}
+	if opts.ResponseCacheSize > 0 {
+		c.cache = newResponseCache(opts.ResponseCacheSize, opts.ResponseCacheMaxTTL)
+	}
+	if opts.Mirror != nil {
+		var err error
+		if c.mirror, err = newMirror(ctrl, opts); err != nil {
+			return nil, err
+		}
 	}
 
 	go func() {
@@ -358,6 +589,10 @@ func newClient(ctrl *Controller, opts *ClientOptions) (*Client, error) {
 	for i := 0; i < opts.ConnPoolSize; i++ {
 		c.shouldConnect <- struct{}{}
 	}
+	go func() {
+		c.maintainLoop(opts)
+		close(c.maintainLoopDone)
+	}()
 	go func() {
 		c.logLoop(ctrl.binaryLogDir, opts.ServiceName)
 		close(c.logLoopDone)
@@ -365,7 +600,13 @@ func newClient(ctrl *Controller, opts *ClientOptions) (*Client, error) {
 	return c, nil
 }
 
-func roundtrip(ctx *ClientContext, conn net.Conn, requestSize, requestBytes []byte) ([]byte, error) {
+func dialTCP(addr string) (net.Conn, error) {
+	return net.Dial("tcp", addr)
+}
+
+// roundtrip writes the request frame on conn and reads the response frame, both followed by
+// their checksums if enabled.
+func roundtrip(ctx *ClientContext, conn net.Conn, checksums bool, request, response *frame) error {
 	deadline, ok := ctx.Deadline()
 	if !ok {
 		deadline = time.Time{}
@@ -373,25 +614,32 @@ func roundtrip(ctx *ClientContext, conn net.Conn, requestSize, requestBytes []by
 
 	var err error
 	if err = conn.SetDeadline(deadline); err != nil {
-		return nil, makeClientErr(err.Error())
-	}
-	if _, err = conn.Write(requestSize); err != nil {
-		return nil, makeClientErrf("Failed to write 4 bytes for request size: %s", err)
+		return makeClientErr(err.Error())
 	}
-	if _, err = conn.Write(requestBytes); err != nil {
-		return nil, makeClientErrf("Failed to write %d bytes for request: %s", err)
+	if err = request.write(conn, checksums); err != nil {
+		return makeClientErrf("Failed to write %d bytes for request: %s", len(request.buf), err)
 	}
-	buf := bytes.NewBuffer(make([]byte, 0, 4))
-	if _, err = io.CopyN(buf, conn, 4); err != nil {
-		return nil, makeClientErrf(
+	responseSize, err := response.readSize(conn)
+	if err != nil {
+		return makeClientErrf(
 			"Failed to read 4 bytes for response size from '%s': %s",
 			conn.RemoteAddr().String(), err)
 	}
-	responseSize := binary.BigEndian.Uint32(buf.Bytes())
-	if _, err = io.CopyN(buf, conn, int64(responseSize)); err != nil {
-		return nil, makeClientErrf(
+	if err = response.readPayload(conn, responseSize); err != nil {
+		return makeClientErrf(
 			"Failed to read %d bytes for response from '%s': %s",
-			conn.RemoteAddr().String(), err)
+			responseSize, conn.RemoteAddr().String(), err)
 	}
-	return buf.Bytes(), nil
+	if checksums {
+		ok, err := response.verifyChecksum(conn)
+		if err != nil {
+			return makeClientErrf(
+				"Failed to read 4 bytes for response checksum from '%s': %s",
+				conn.RemoteAddr().String(), err)
+		}
+		if !ok {
+			return ErrChecksumMismatch
+		}
+	}
+	return nil
 }
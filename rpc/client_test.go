@@ -0,0 +1,71 @@
+package rpc
+
+import (
+	"testing"
+	"time"
+
+	"github.com/xinlaini/golibs/log"
+)
+
+func newTestController(t *testing.T) *Controller {
+	ctrl, err := NewController(Config{Logger: xlog.NewNilLogger()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ctrl
+}
+
+func TestConnExpiry(t *testing.T) {
+	now := time.Now()
+	if expiry := connExpiry(&ClientOptions{}, now); !expiry.IsZero() {
+		t.Errorf("Connections without MaxConnectionAge expire at %v", expiry)
+	}
+
+	opts := &ClientOptions{MaxConnectionAge: time.Minute, MaxConnectionAgeJitter: 0.5}
+	for i := 0; i < 100; i++ {
+		age := connExpiry(opts, now).Sub(now)
+		if age < 30*time.Second || age > 90*time.Second {
+			t.Fatalf("Jittered max age %s is not within 50%% of %s", age, opts.MaxConnectionAge)
+		}
+	}
+}
+
+func TestMaxConnectionAgeJitterDefaults(t *testing.T) {
+	ctrl := newTestController(t)
+	for _, test := range []struct {
+		jitter float64
+		want   float64
+	}{
+		{0, DefaultMaxConnectionAgeJitter},
+		{0.3, 0.3},
+		{-1, 0},
+	} {
+		opts := ClientOptions{
+			ServiceName:            "Echo",
+			ServiceAddr:            "pipe:0",
+			ConnPoolSize:           1,
+			Retry:                  DefaultDialRetry,
+			MaxConnectionAge:       time.Minute,
+			MaxConnectionAgeJitter: test.jitter,
+		}
+		c, err := newClient(ctrl, &opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		c.Close()
+		if opts.MaxConnectionAgeJitter != test.want {
+			t.Errorf("MaxConnectionAgeJitter %v became %v, want %v", test.jitter, opts.MaxConnectionAgeJitter, test.want)
+		}
+		if test.want == 0 {
+			now := time.Now()
+			if age := connExpiry(&opts, now).Sub(now); age != time.Minute {
+				t.Errorf("Max age without jitter is %s, want 1m0s", age)
+			}
+		}
+	}
+
+	opts := ClientOptions{MaxConnectionAgeJitter: 1}
+	if _, err := newClient(ctrl, &opts); err == nil {
+		t.Error("MaxConnectionAgeJitter 1 is valid")
+	}
+}
@@ -1,6 +1,9 @@
 package rpc
 
 import (
+	"errors"
+	"time"
+
 	"golang.org/x/net/context"
 
 	"gen/pb/rpc/rpc_proto"
@@ -9,9 +12,67 @@ import (
 type ServerContext struct {
 	context.Context
 	Metadata *rpc_proto.RequestMetadata
+	// DeadlineClamped tells whether the client's deadline was cut short by MaxDeadline.
+	DeadlineClamped bool
+	// RequestHeader is the custom metadata sent by the client.
+	RequestHeader MD
+	// ResponseHeader and ResponseTrailer are sent back to the client along with the response
+	// or app-level error. They are dropped if the method times out or panics.
+	ResponseHeader  MD
+	ResponseTrailer MD
+	// CacheMaxAge, if >0, lets clients cache a successful response for up to this long.
+	CacheMaxAge time.Duration
+
+	// timeout is the deadline applied by the server, 0 if none.
+	timeout time.Duration
 }
 
 type ClientContext struct {
 	context.Context
 	Metadata *rpc_proto.ResponseMetadata
+	// FailFast fails the call with ErrUnavailable while the Client is in TransientFailure,
+	// rather than waiting for a connection until the context is done. Like in gRPC, calls
+	// still wait while the Client is Connecting, since the first dial may well succeed.
+	FailFast bool
+	// Priority orders the call on servers with a bounded dispatcher.
+	Priority Priority
+	// RequestHeader is custom metadata sent to the server.
+	RequestHeader MD
+	// IdempotencyKey, if set, makes a server with an idempotency cache run the call at most
+	// once per key. Retries with the same key get the original response replayed.
+	IdempotencyKey string
+	// ResponseHeader and ResponseTrailer are set from the server's response.
+	ResponseHeader  MD
+	ResponseTrailer MD
+	// BypassCache skips the response cache of the Client for this call. A cacheable response
+	// still refreshes the cache.
+	BypassCache bool
+	// CacheHit tells whether the response came from the cache of the Client, without a round
+	// trip.
+	CacheHit bool
+	// RoundTripTime is how long the call took on the wire and in the server. NetworkTime is
+	// its share spent outside the server's queue and method handler.
+	RoundTripTime time.Duration
+	NetworkTime   time.Duration
+}
+
+// setResponse fills ctx from response, whose RoundTripTime must be set already, and returns the
+// response payload.
+func (ctx *ClientContext) setResponse(response *rpc_proto.Response) ([]byte, error) {
+	ctx.Metadata = response.Metadata
+	serverTime := time.Duration(
+		response.GetMetadata().GetQueueDelayUs()+response.GetMetadata().GetHandlerLatencyUs()) * time.Microsecond
+	if ctx.NetworkTime = ctx.RoundTripTime - serverTime; ctx.NetworkTime < 0 {
+		ctx.NetworkTime = 0
+	}
+	ctx.ResponseHeader = mdFromPB(response.GetMetadata().GetHeaders())
+	ctx.ResponseTrailer = mdFromPB(response.GetMetadata().GetTrailers())
+	if response.Error != nil {
+		if response.GetError() == ErrIdempotencyKeyReused.Error() {
+			return nil, ErrIdempotencyKeyReused
+		}
+		// Copy the response error verbatim.
+		return nil, errors.New(response.GetError())
+	}
+	return response.ResponsePb, nil
 }
@@ -1,17 +1,55 @@
 package rpc
 
 import (
+	"net"
 	"net/http"
 	"os"
 	"reflect"
 	"sync"
+	"time"
 
 	"github.com/xinlaini/golibs/log"
 )
 
+// RawHandler serves every method of a service on serialized payloads. The method name is in
+// ctx.Metadata. A nil request or response payload stands for a nil message.
+type RawHandler func(ctx *ServerContext, requestPB []byte) ([]byte, error)
+
+// ListenerConfig is an address to serve on, e.g. a port restricted to localhost or a Unix
+// socket, and the services exposed there.
+type ListenerConfig struct {
+	// Network and Addr are passed to net.Listen, Network defaults to "tcp".
+	Network string
+	Addr    string
+	// Listener, if set, is served on instead of listening on Network and Addr.
+	Listener net.Listener
+	// Services restricts the listener to these services, empty exposes all of them. They must
+	// be registered when ServeAll is called.
+	Services []string
+}
+
+// MethodConfig bounds how long calls of a method may run on the server.
+type MethodConfig struct {
+	// DefaultDeadline applies when the client sends no deadline, 0 means none.
+	DefaultDeadline time.Duration
+	// MaxDeadline cuts longer client deadlines short, 0 means no limit.
+	MaxDeadline time.Duration
+}
+
+// MethodStats counts noteworthy events of a method.
+type MethodStats struct {
+	Panics int64
+	// ClampedDeadlines counts calls whose client deadline exceeded MaxDeadline.
+	ClampedDeadlines int64
+}
+
 type ServiceConfig struct {
 	Type reflect.Type
 	Impl interface{}
+	// Raw, if set, is used instead of Type and Impl, e.g. for fakes in tests.
+	Raw RawHandler
+	// Methods configures individual methods by name.
+	Methods map[string]MethodConfig
 }
 
 type Config struct {
@@ -19,12 +57,50 @@ type Config struct {
 	BinaryLogDir string
 	HTTPMux      *http.ServeMux
 	Services     map[string]ServiceConfig
+	// ConnIdleTimeout closes server connections without any traffic, pings included, for
+	// longer. 0 keeps idle connections open forever.
+	ConnIdleTimeout time.Duration
+	// PropagatePanics lets a panicking method handler crash the process, for debugging.
+	// Otherwise the panic is logged and the call fails.
+	PropagatePanics bool
+	// IdempotencyCacheSize is how many responses to calls with an idempotency key are kept to
+	// be replayed to retries, for up to IdempotencyTTL each. 0 disables the cache.
+	IdempotencyCacheSize int
+	// IdempotencyTTL defaults to DefaultIdempotencyTTL.
+	IdempotencyTTL time.Duration
+	// StrictServices fails registration of a service if any method of its Type can't be
+	// served, listing each with the reason. Otherwise such methods are skipped.
+	StrictServices bool
+	// MaxConcurrentRequests bounds the requests run at once, across all connections. Others
+	// wait, highest Priority first, in a queue of up to MaxQueuedRequests, which defaults to
+	// MaxConcurrentRequests. When the queue is full, the lowest priority requests are shed.
+	// 0 runs every request as it arrives.
+	MaxConcurrentRequests int
+	MaxQueuedRequests     int
+	// MaxBatchSize rejects batches of more calls, defaults to DefaultMaxBatchSize.
+	MaxBatchSize int
+	// MaxBatchConcurrency bounds the calls of an unordered batch run at once, defaults to
+	// DefaultMaxBatchConcurrency. MaxConcurrentRequests applies to them as well.
+	MaxBatchConcurrency int
+	// AccessLog, if set, logs every served request, or a sample of them.
+	AccessLog *AccessLogConfig
+	// FaultInjectionHTTP serves /rpc/faults on HTTPMux, letting anyone who can reach it
+	// inject faults. Off by default, SetFaultRules works either way.
+	FaultInjectionHTTP bool
+	// RPCZCancelHTTP lets anyone who can reach /rpcz on HTTPMux cancel in-flight requests. Off
+	// by default, /rpcz only lists them.
+	RPCZCancelHTTP bool
 }
 
 type Controller struct {
-	logger       xlog.Logger
-	binaryLogDir string
+	logger          xlog.Logger
+	binaryLogDir    string
+	propagatePanics bool
+	strictServices  bool
 
+	faults *faultInjector
+	// inflight is nil without HTTPMux, as nothing would list the requests.
+	inflight   *inflightRequests
 	server     *server
 	clients    []*Client
 	mtxClients sync.RWMutex
@@ -34,6 +110,18 @@ func (ctrl *Controller) Serve(port int) error {
 	return ctrl.server.serve(port)
 }
 
+// ServeListener serves on a caller-provided listener, e.g. one inherited through socket
+// activation or a PipeListener. It takes ownership of l and closes it when returning.
+func (ctrl *Controller) ServeListener(l net.Listener) error {
+	return ctrl.server.serveListener(l, nil)
+}
+
+// ServeAll serves on several listeners at once, each exposing all or some of the services. It
+// binds all of them before serving any, and returns once any of them fails.
+func (ctrl *Controller) ServeAll(listeners ...ListenerConfig) error {
+	return ctrl.server.serveAll(listeners)
+}
+
 func (ctrl *Controller) NewClient(opts ClientOptions) (*Client, error) {
 	c, err := newClient(ctrl, &opts)
 	if err != nil {
@@ -45,13 +133,59 @@ func (ctrl *Controller) NewClient(opts ClientOptions) (*Client, error) {
 	return c, nil
 }
 
+// RegisterService starts serving a service, possibly while already serving others.
+func (ctrl *Controller) RegisterService(name string, cfg ServiceConfig) error {
+	svc, err := newService(ctrl, name, &cfg)
+	if err != nil {
+		return err
+	}
+	if err = ctrl.server.registerService(name, svc); err != nil {
+		svc.close()
+		return err
+	}
+	return nil
+}
+
+// UnregisterService stops serving a service. Calls in flight still complete, new ones fail.
+func (ctrl *Controller) UnregisterService(name string) error {
+	if err := ctrl.server.unregisterService(name); err != nil {
+		return err
+	}
+	ctrl.logger.Infof("Service '%s' is unregistered", name)
+	return nil
+}
+
+func (ctrl *Controller) MethodStats(serviceName, methodName string) MethodStats {
+	svc, found := ctrl.server.service(serviceName)
+	if !found {
+		return MethodStats{}
+	}
+	return svc.methodStats(methodName)
+}
+
+// SetFaultRules replaces the fault injection rules of the served requests and of the calls of
+// the clients of ctrl. A nil list disables fault injection.
+func (ctrl *Controller) SetFaultRules(rules []FaultRule) error {
+	return ctrl.faults.setRules(rules)
+}
+
+func (ctrl *Controller) FaultRules() []FaultRule {
+	return ctrl.faults.getRules()
+}
+
 func (ctrl *Controller) showRPCs(w http.ResponseWriter, req *http.Request) {
 }
 
 func NewController(config Config) (*Controller, error) {
 	ctrl := &Controller{
-		logger:       config.Logger,
-		binaryLogDir: config.BinaryLogDir,
+		logger:          config.Logger,
+		binaryLogDir:    config.BinaryLogDir,
+		propagatePanics: config.PropagatePanics,
+		strictServices:  config.StrictServices,
+		faults:          newFaultInjector(),
+	}
+	if config.HTTPMux != nil {
+		ctrl.inflight = newInflightRequests(config.RPCZCancelHTTP)
 	}
 
 	var err error
@@ -61,13 +195,17 @@ func NewController(config Config) (*Controller, error) {
 		}
 	}
 
-	if ctrl.server, err = newServer(ctrl, config.Services); err != nil {
+	if ctrl.server, err = newServer(ctrl, &config); err != nil {
 		return nil, err
 	}
 	if config.HTTPMux != nil {
 		config.HTTPMux.HandleFunc("/rpcs", func(w http.ResponseWriter, req *http.Request) {
 			ctrl.showRPCs(w, req)
 		})
+		if config.FaultInjectionHTTP {
+			config.HTTPMux.HandleFunc("/rpc/faults", ctrl.faults.serveHTTP)
+		}
+		config.HTTPMux.HandleFunc("/rpcz", ctrl.inflight.serveHTTP)
 	}
 	return ctrl, nil
 }
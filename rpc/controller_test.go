@@ -0,0 +1,153 @@
+package rpc_test
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"gen/pb/rpc/rpc_proto"
+
+	"github.com/xinlaini/golibs/log"
+	"github.com/xinlaini/golibs/rpc"
+	"github.com/xinlaini/golibs/rpc/rpctest"
+)
+
+func TestRegisterServices(t *testing.T) {
+	// A controller without services serves, and reports every service as not found.
+	s, c := startPipeServer(t, rpc.Config{}, "KV")
+	defer s.Close()
+	defer c.Close()
+	if _, err := call(c, nil, "Get", "a"); err == nil || !strings.Contains(err.Error(), "not found") {
+		t.Errorf("Get before RegisterService failed with %v, want not found", err)
+	}
+
+	if err := s.Controller.RegisterService("KV", kvServiceConfig()); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Controller.RegisterService("KV", kvServiceConfig()); err == nil {
+		t.Error("Registering KV twice succeeded")
+	}
+	if got, err := call(c, nil, "Get", "a"); err != nil || got != "value of a" {
+		t.Errorf("Get after RegisterService = %q, %v", got, err)
+	}
+
+	if err := s.Controller.UnregisterService("KV"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Controller.UnregisterService("KV"); err == nil {
+		t.Error("Unregistering KV twice succeeded")
+	}
+	if _, err := call(c, nil, "Get", "a"); err == nil || !strings.Contains(err.Error(), "not found") {
+		t.Errorf("Get after UnregisterService failed with %v, want not found", err)
+	}
+}
+
+// partialService has methods whose signatures can't be served.
+type partialService interface {
+	Get(ctx *rpc.ServerContext, request *rpc_proto.KeyValue) (*rpc_proto.KeyValue, error)
+	NoContext(request *rpc_proto.KeyValue) (*rpc_proto.KeyValue, error)
+	ByValue(ctx *rpc.ServerContext, request *rpc_proto.KeyValue) (rpc_proto.KeyValue, error)
+}
+
+type partialServiceImpl struct {
+	kvServiceImpl
+}
+
+func (partialServiceImpl) NoContext(request *rpc_proto.KeyValue) (*rpc_proto.KeyValue, error) {
+	return request, nil
+}
+
+func (partialServiceImpl) ByValue(ctx *rpc.ServerContext, request *rpc_proto.KeyValue) (rpc_proto.KeyValue, error) {
+	return *request, nil
+}
+
+func TestStrictServices(t *testing.T) {
+	cfg := rpc.ServiceConfig{
+		Type: reflect.TypeOf((*partialService)(nil)).Elem(),
+		Impl: partialServiceImpl{},
+	}
+	_, err := rpc.NewController(rpc.Config{
+		Logger:         xlog.NewNilLogger(),
+		Services:       map[string]rpc.ServiceConfig{"Partial": cfg},
+		StrictServices: true,
+	})
+	if err == nil || !strings.Contains(err.Error(), "NoContext") || !strings.Contains(err.Error(), "ByValue") {
+		t.Errorf("Strict NewController() failed with %v, want both bad methods rejected", err)
+	}
+
+	s, c := startPipeServer(t, rpc.Config{
+		Services: map[string]rpc.ServiceConfig{"Partial": cfg},
+	}, "Partial")
+	defer s.Close()
+	defer c.Close()
+	if got, err := call(c, nil, "Get", "a"); err != nil || got != "value of a" {
+		t.Errorf("Get = %q, %v", got, err)
+	}
+	if _, err := call(c, nil, "NoContext", "a"); err == nil {
+		t.Error("NoContext is served")
+	}
+}
+
+func TestServeAll(t *testing.T) {
+	ctrl, err := rpc.NewController(rpc.Config{
+		Logger: xlog.NewNilLogger(),
+		Services: map[string]rpc.ServiceConfig{
+			"Admin":  echoService(),
+			"Public": echoService(),
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ctrl.ServeAll(); err == nil {
+		t.Error("ServeAll() without listeners succeeded")
+	}
+	unused := rpc.NewPipeListener()
+	defer unused.Close()
+	err = ctrl.ServeAll(rpc.ListenerConfig{Listener: unused, Services: []string{"Pubilc"}})
+	if err == nil || !strings.Contains(err.Error(), "Pubilc") {
+		t.Errorf("ServeAll() with an unknown service failed with %v", err)
+	}
+
+	internal, public := rpc.NewPipeListener(), rpc.NewPipeListener()
+	done := make(chan error, 1)
+	go func() {
+		done <- ctrl.ServeAll(
+			rpc.ListenerConfig{Listener: internal},
+			rpc.ListenerConfig{Listener: public, Services: []string{"Public"}})
+	}()
+	for _, test := range []struct {
+		listener    string
+		l           *rpc.PipeListener
+		serviceName string
+		wantErr     bool
+	}{
+		{"internal", internal, "Admin", false},
+		{"internal", internal, "Public", false},
+		{"public", public, "Admin", true},
+		{"public", public, "Public", false},
+	} {
+		opts := rpc.ClientOptions{
+			ServiceName:  test.serviceName,
+			ServiceAddr:  test.l.Addr().String(),
+			ConnPoolSize: 1,
+			Retry:        rpctest.TestDialRetry,
+			Dial:         test.l.Dial,
+		}
+		c := newClient(t, opts)
+		_, err := call(c, nil, "Get", "a")
+		c.Close()
+		if (err != nil) != test.wantErr {
+			t.Errorf("Calling %s on the %s listener failed with %v", test.serviceName, test.listener, err)
+		}
+	}
+
+	// Closing one listener stops serving on all of them.
+	public.Close()
+	if err := <-done; err == nil {
+		t.Error("ServeAll() returned nil")
+	}
+	if _, err := internal.Dial(""); err == nil {
+		t.Error("Internal listener is still open")
+	}
+}
@@ -4,7 +4,7 @@ import (
 	"flag"
 	"time"
 
-	hello_proto "gen/pb/rpc/example/hello_proto"
+	"gen/pb/rpc/example/header_proto"
 	"gen/pb/rpc/example/say_proto"
 	"gen/pb/rpc/example/sing_proto"
 	"gen/rpc/rpc/example"
@@ -65,10 +65,10 @@ func main() {
 
 	runSay(logger, helloClient, nil)
 	runSay(logger, helloClient, &say.Request{})
-	runSay(logger, helloClient, &say.Request{Hdr: &hello_proto.Header{}, Body: proto.String("say body")})
+	runSay(logger, helloClient, &say.Request{Hdr: &header_proto.Header{}, Body: proto.String("say body")})
 
 	runSing(logger, helloClient, nil)
 	runSing(logger, helloClient, &sing.Request{})
-	runSing(logger, helloClient, &sing.Request{Hdr: &hello_proto.Header{}, Body: proto.String("sing body")})
+	runSing(logger, helloClient, &sing.Request{Hdr: &header_proto.Header{}, Body: proto.String("sing body")})
 	helloClient.Close()
 }
@@ -58,7 +58,7 @@ func main() {
 	ctrl, err := rpc.NewController(rpc.Config{
 		Logger: logger,
 		Services: map[string]rpc.ServiceConfig{
-			"Hello": {hello.HelloServiceType, &helloService{logger: logger}},
+			"Hello": {Type: hello.HelloServiceType, Impl: &helloService{logger: logger}},
 		},
 	})
 	if err != nil {
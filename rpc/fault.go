@@ -0,0 +1,163 @@
+package rpc
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"sync"
+	"time"
+
+	"gen/pb/rpc/rpc_proto"
+
+	"golang.org/x/net/context"
+)
+
+// FaultRule makes a share of the matching calls misbehave on purpose, to exercise resilience
+// logic. It first delays the call by Delay if set, then fails it with Error, or drops its
+// connection, if set.
+type FaultRule struct {
+	// Service, Method and ClientJob match calls by service name, method name and client job
+	// name. Empty fields match everything.
+	Service   string
+	Method    string
+	ClientJob string
+	// OnClient applies the rule to the calls made by the clients of the Controller, instead of
+	// the requests served by it.
+	OnClient bool
+	// Percent of the matching calls affected, in (0, 100].
+	Percent float64
+
+	Delay time.Duration
+	// Error is returned verbatim as the error of the call.
+	Error string
+	// Drop closes the connection of the call instead of answering it.
+	Drop bool
+}
+
+func (rule *FaultRule) validate() error {
+	if rule.Percent <= 0 || rule.Percent > 100 {
+		return errors.New("FaultRule.Percent must be in (0, 100]")
+	}
+	if rule.Delay < 0 {
+		return errors.New("FaultRule.Delay must be >=0")
+	}
+	if rule.Delay == 0 && rule.Error == "" && !rule.Drop {
+		return errors.New("FaultRule must set at least one of Delay, Error and Drop")
+	}
+	if rule.Error != "" && rule.Drop {
+		return errors.New("FaultRule cannot set both Error and Drop")
+	}
+	return nil
+}
+
+func (rule *FaultRule) matches(onClient bool, reqMeta *rpc_proto.RequestMetadata) bool {
+	return rule.OnClient == onClient &&
+		(rule.Service == "" || rule.Service == reqMeta.GetServiceName()) &&
+		(rule.Method == "" || rule.Method == reqMeta.GetMethodName()) &&
+		(rule.ClientJob == "" || rule.ClientJob == reqMeta.GetClientJobName())
+}
+
+var (
+	errFaultDropped = errors.New("Connection dropped by fault injection")
+)
+
+type faultInjector struct {
+	rules []FaultRule
+	rnd   *rand.Rand
+	mtx   sync.Mutex
+}
+
+// pick returns the first rule matching the call that it decides to apply, or nil.
+func (fi *faultInjector) pick(onClient bool, reqMeta *rpc_proto.RequestMetadata) *FaultRule {
+	fi.mtx.Lock()
+	defer fi.mtx.Unlock()
+	for i := range fi.rules {
+		rule := &fi.rules[i]
+		if rule.matches(onClient, reqMeta) && fi.rnd.Float64()*100 < rule.Percent {
+			picked := *rule
+			return &picked
+		}
+	}
+	return nil
+}
+
+// inject applies the rule picked for the call, if any. It returns errFaultDropped if the
+// connection should be dropped, the error of the rule, or nil to proceed with the call.
+func (fi *faultInjector) inject(
+	ctx context.Context, onClient bool, reqMeta *rpc_proto.RequestMetadata) error {
+	rule := fi.pick(onClient, reqMeta)
+	if rule == nil {
+		return nil
+	}
+	if rule.Delay > 0 {
+		timer := time.NewTimer(rule.Delay)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		}
+	}
+	if rule.Drop {
+		return errFaultDropped
+	}
+	if rule.Error != "" {
+		return errors.New(rule.Error)
+	}
+	return nil
+}
+
+func (fi *faultInjector) setRules(rules []FaultRule) error {
+	for i := range rules {
+		if err := rules[i].validate(); err != nil {
+			return fmt.Errorf("Rule %d: %s", i, err)
+		}
+	}
+	fi.mtx.Lock()
+	fi.rules = append([]FaultRule(nil), rules...)
+	fi.mtx.Unlock()
+	return nil
+}
+
+func (fi *faultInjector) getRules() []FaultRule {
+	fi.mtx.Lock()
+	defer fi.mtx.Unlock()
+	return append([]FaultRule(nil), fi.rules...)
+}
+
+// serveHTTP lists the rules as JSON on GET, replaces them with a JSON list on PUT or POST, and
+// clears them on DELETE. Delays are in nanoseconds.
+func (fi *faultInjector) serveHTTP(w http.ResponseWriter, req *http.Request) {
+	switch req.Method {
+	case "GET":
+	case "PUT", "POST":
+		var rules []FaultRule
+		if err := json.NewDecoder(req.Body).Decode(&rules); err != nil {
+			http.Error(w, fmt.Sprintf("Failed to decode fault rules: %s", err), http.StatusBadRequest)
+			return
+		}
+		if err := fi.setRules(rules); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	case "DELETE":
+		fi.setRules(nil)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	rules := fi.getRules()
+	if rules == nil {
+		rules = []FaultRule{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(rules)
+}
+
+func newFaultInjector() *faultInjector {
+	return &faultInjector{
+		rnd: rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+}
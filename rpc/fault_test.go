@@ -0,0 +1,113 @@
+package rpc_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/xinlaini/golibs/log"
+	"github.com/xinlaini/golibs/rpc"
+)
+
+func TestFaultRules(t *testing.T) {
+	s, c := startPipeServer(t, rpc.Config{
+		Services: map[string]rpc.ServiceConfig{"Echo": echoService()},
+	}, "Echo")
+	defer s.Close()
+	defer c.Close()
+
+	for _, test := range []struct {
+		rule    rpc.FaultRule
+		wantErr string
+	}{
+		{rpc.FaultRule{Method: "Get", Percent: 100, Error: "server fault"}, "server fault"},
+		{rpc.FaultRule{Method: "Get", OnClient: true, Percent: 100, Error: "client fault"}, "client fault"},
+		{rpc.FaultRule{Method: "Put", Percent: 100, Error: "server fault"}, ""},
+		{rpc.FaultRule{Service: "Other", OnClient: true, Percent: 100, Error: "client fault"}, ""},
+		{rpc.FaultRule{Method: "Get", Percent: 100, Delay: time.Millisecond}, ""},
+	} {
+		if err := s.Controller.SetFaultRules([]rpc.FaultRule{test.rule}); err != nil {
+			t.Fatal(err)
+		}
+		_, err := call(c, nil, "Get", "a")
+		if test.wantErr == "" && err != nil {
+			t.Errorf("Call with rule %+v failed: %s", test.rule, err)
+		} else if test.wantErr != "" && (err == nil || !strings.Contains(err.Error(), test.wantErr)) {
+			t.Errorf("Call with rule %+v failed with %v, want %q", test.rule, err, test.wantErr)
+		}
+	}
+
+	if err := s.Controller.SetFaultRules([]rpc.FaultRule{{Percent: 100}}); err == nil {
+		t.Error("SetFaultRules accepted a rule without a fault")
+	}
+	if err := s.Controller.SetFaultRules(nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := call(c, nil, "Get", "a"); err != nil {
+		t.Errorf("Call without rules failed: %s", err)
+	}
+}
+
+func TestFaultDropsConnectionOfCall(t *testing.T) {
+	l, opts := startCountingServer(t, rpc.Config{
+		Services: map[string]rpc.ServiceConfig{"Echo": echoService()},
+	}, "Echo")
+	defer l.Close()
+	ctrl, err := rpc.NewController(rpc.Config{Logger: xlog.NewNilLogger()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := ctrl.NewClient(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if _, err := call(c, nil, "Get", "a"); err != nil {
+		t.Fatal(err)
+	}
+
+	err = ctrl.SetFaultRules([]rpc.FaultRule{{Method: "Drop", OnClient: true, Percent: 100, Drop: true}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := call(c, nil, "Drop", "a"); err == nil {
+		t.Error("Call with a dropped connection succeeded")
+	}
+	// The only connection of the pool was dropped, and replaced.
+	if _, err := call(c, nil, "Get", "a"); err != nil {
+		t.Errorf("Call after the drop failed: %s", err)
+	}
+	if got := l.numAccepted(); got != 2 {
+		t.Errorf("Server accepted %d connections, want 2", got)
+	}
+}
+
+func TestFaultInjectionHTTP(t *testing.T) {
+	for _, enabled := range []bool{false, true} {
+		mux := http.NewServeMux()
+		ctrl, err := rpc.NewController(rpc.Config{
+			Logger:             xlog.NewNilLogger(),
+			HTTPMux:            mux,
+			FaultInjectionHTTP: enabled,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, httptest.NewRequest(
+			"PUT", "/rpc/faults", strings.NewReader(`[{"Percent": 50, "Error": "fault"}]`)))
+
+		wantCode, wantRules := http.StatusNotFound, 0
+		if enabled {
+			wantCode, wantRules = http.StatusOK, 1
+		}
+		if w.Code != wantCode {
+			t.Errorf("PUT /rpc/faults with FaultInjectionHTTP=%t returned %d, want %d", enabled, w.Code, wantCode)
+		}
+		if got := len(ctrl.FaultRules()); got != wantRules {
+			t.Errorf("Got %d rules with FaultInjectionHTTP=%t, want %d", got, enabled, wantRules)
+		}
+	}
+}
@@ -0,0 +1,265 @@
+package rpc
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// ProtocolVersion is the latest wire protocol version spoken by this package.
+	ProtocolVersion = 1
+
+	DefaultHandshakeTimeout = 3 * time.Second
+
+	handshakeSize = 12
+	// maxLegacyFrameSize is large enough for any sane first frame of a legacy client, and small
+	// enough to tell other protocols apart, e.g. HTTP or TLS.
+	maxLegacyFrameSize = 256 << 20
+)
+
+var (
+	// protocolMagic opens the handshake. Read as the length prefix of a legacy frame it would
+	// be well over a gigabyte, so servers tell both apart from the first 4 bytes.
+	protocolMagic = []byte("XRPC")
+
+	errBadMagic = errors.New("Peer is not speaking the RPC protocol")
+
+	// legacyRetryInterval is how long new connections to a server speak the legacy protocol
+	// after falling back, before trying the handshake again. It doubles with each fallback in a
+	// row, up to maxLegacyRetryInterval.
+	legacyRetryInterval    = time.Minute
+	maxLegacyRetryInterval = time.Hour
+
+	legacyPeers = newLegacyPeerSet()
+)
+
+// Capabilities is a set of optional protocol features. A connection uses those supported by
+// both peers.
+type Capabilities uint32
+
+const (
+	CapChecksums Capabilities = 1 << iota
+	CapCompression
+	CapMultiplexing
+)
+
+var (
+	capabilityNames = []string{"checksums", "compression", "multiplexing"}
+)
+
+// supportedCapabilities are those implemented by this package.
+const supportedCapabilities = CapChecksums
+
+func (caps Capabilities) String() string {
+	var names []string
+	for i, name := range capabilityNames {
+		if caps&(1<<uint(i)) != 0 {
+			names = append(names, name)
+		}
+	}
+	if len(names) == 0 {
+		return "none"
+	}
+	return strings.Join(names, ",")
+}
+
+// HandshakeMode controls whether a Client opens its connections with a handshake.
+type HandshakeMode int
+
+const (
+	// HandshakeAuto handshakes, but falls back to the legacy protocol, without handshake, if
+	// the server closes the connection, answers something else, or doesn't answer in time.
+	// Connections to the same address skip the handshake for a minute after that, then retry
+	// it, e.g. once the server has been upgraded. The wait doubles with each fallback in a row,
+	// up to an hour.
+	HandshakeAuto HandshakeMode = iota
+	// HandshakeRequired fails connections to servers that don't handshake.
+	HandshakeRequired
+	// HandshakeOff speaks the legacy protocol, for servers that predate the handshake.
+	HandshakeOff
+)
+
+// The handshake is 12 bytes each way: the magic, a 2-byte version, 2 reserved bytes and a
+// 4-byte capability set, all big-endian. The client sends the latest version and all the
+// capabilities it supports, the server answers with the version and capabilities to use.
+func encodeHandshake(version uint16, caps Capabilities) []byte {
+	buf := make([]byte, handshakeSize)
+	copy(buf, protocolMagic)
+	binary.BigEndian.PutUint16(buf[4:], version)
+	binary.BigEndian.PutUint32(buf[8:], uint32(caps))
+	return buf
+}
+
+func decodeHandshake(buf []byte) (uint16, Capabilities, error) {
+	if !bytes.Equal(buf[:4], protocolMagic) {
+		return 0, 0, errBadMagic
+	}
+	version := binary.BigEndian.Uint16(buf[4:])
+	if version == 0 {
+		return 0, 0, errors.New("Invalid protocol version 0")
+	}
+	return version, Capabilities(binary.BigEndian.Uint32(buf[8:])), nil
+}
+
+// clientHandshake negotiates the protocol on a new connection within timeout, offering caps.
+func clientHandshake(
+	conn net.Conn, caps Capabilities, timeout time.Duration) (uint16, Capabilities, error) {
+	if err := conn.SetDeadline(time.Now().Add(timeout)); err != nil {
+		return 0, 0, err
+	}
+	defer conn.SetDeadline(time.Time{})
+
+	if _, err := conn.Write(encodeHandshake(ProtocolVersion, caps)); err != nil {
+		return 0, 0, err
+	}
+	// A server not speaking the handshake is told apart as soon as it answers anything else.
+	buf := make([]byte, handshakeSize)
+	if _, err := io.ReadFull(conn, buf[:len(protocolMagic)]); err != nil {
+		return 0, 0, err
+	}
+	if !bytes.Equal(buf[:len(protocolMagic)], protocolMagic) {
+		return 0, 0, errBadMagic
+	}
+	if _, err := io.ReadFull(conn, buf[len(protocolMagic):]); err != nil {
+		return 0, 0, err
+	}
+	version, chosen, err := decodeHandshake(buf)
+	if err != nil {
+		return 0, 0, err
+	}
+	if version > ProtocolVersion || chosen&^caps != 0 {
+		return 0, 0, fmt.Errorf(
+			"Server chose protocol version %d with capabilities %s, which weren't offered",
+			version, chosen)
+	}
+	return version, chosen, nil
+}
+
+// serverHandshake answers the handshake of a client, whose magic is already read. It returns
+// the negotiated protocol.
+func serverHandshake(conn net.Conn, magic []byte) (uint16, Capabilities, error) {
+	buf := make([]byte, handshakeSize)
+	copy(buf, magic)
+	if _, err := io.ReadFull(conn, buf[len(magic):]); err != nil {
+		return 0, 0, err
+	}
+	version, caps, err := decodeHandshake(buf)
+	if err != nil {
+		return 0, 0, err
+	}
+	if version > ProtocolVersion {
+		version = ProtocolVersion
+	}
+	caps &= supportedCapabilities
+	if _, err = conn.Write(encodeHandshake(version, caps)); err != nil {
+		return 0, 0, err
+	}
+	return version, caps, nil
+}
+
+// prefixedConn replays bytes already read from a connection before reading further.
+type prefixedConn struct {
+	net.Conn
+	r io.Reader
+}
+
+func (conn *prefixedConn) Read(b []byte) (int, error) {
+	return conn.r.Read(b)
+}
+
+// dialProtocol dials a new connection and negotiates its protocol, falling back to the legacy
+// protocol depending on the handshake mode.
+func (c *Client) dialProtocol() (net.Conn, Capabilities, error) {
+	conn, err := c.dial(c.serviceAddr)
+	if err != nil || c.handshakeMode == HandshakeOff ||
+		(c.handshakeMode == HandshakeAuto && c.legacyPeers.isLegacy(c.serviceAddr)) {
+		return conn, 0, err
+	}
+	version, caps, err := clientHandshake(conn, c.caps, c.handshakeTimeout)
+	if err == nil {
+		c.logger.Infof(
+			"Connection to '%s' speaks protocol v%d with capabilities %s", c.serviceAddr, version, caps)
+		c.legacyPeers.handshook(c.serviceAddr)
+		return conn, caps, nil
+	}
+	conn.Close()
+	if c.handshakeMode == HandshakeRequired || !isLegacyAnswer(err) {
+		return nil, 0, fmt.Errorf("Handshake failed: %s", err)
+	}
+	interval := c.legacyPeers.fellBack(c.serviceAddr)
+	c.logger.Infof(
+		"Server at '%s' doesn't handshake (%s), speaking the legacy protocol to it for %s",
+		c.serviceAddr, err, interval)
+	conn, err = c.dial(c.serviceAddr)
+	return conn, 0, err
+}
+
+// isLegacyAnswer reports whether the handshake failed with err as it would with a server
+// predating it: one that answers something else, closes the connection or doesn't answer.
+func isLegacyAnswer(err error) bool {
+	if err == errBadMagic || err == io.EOF || err == io.ErrUnexpectedEOF {
+		return true
+	}
+	ne, ok := err.(net.Error)
+	return ok && ne.Timeout()
+}
+
+type legacyPeer struct {
+	// until is when to retry the handshake.
+	until    time.Time
+	interval time.Duration
+}
+
+// legacyPeerSet remembers, by address, the servers found not to handshake.
+type legacyPeerSet struct {
+	peers map[string]*legacyPeer
+	mtx   sync.Mutex
+}
+
+// isLegacy reports whether new connections to addr skip the handshake, after a recent fallback.
+func (s *legacyPeerSet) isLegacy(addr string) bool {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	peer, found := s.peers[addr]
+	return found && time.Now().Before(peer.until)
+}
+
+// fellBack records a fallback with addr, and returns how long it holds.
+func (s *legacyPeerSet) fellBack(addr string) time.Duration {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	now := time.Now()
+	peer, found := s.peers[addr]
+	switch {
+	case !found:
+		peer = &legacyPeer{interval: legacyRetryInterval}
+		s.peers[addr] = peer
+	case now.Before(peer.until):
+		// Another connection fell back meanwhile.
+		return peer.interval
+	case peer.interval*2 > maxLegacyRetryInterval:
+		peer.interval = maxLegacyRetryInterval
+	default:
+		peer.interval *= 2
+	}
+	peer.until = now.Add(peer.interval)
+	return peer.interval
+}
+
+// handshook forgets addr, whose server handshakes now.
+func (s *legacyPeerSet) handshook(addr string) {
+	s.mtx.Lock()
+	delete(s.peers, addr)
+	s.mtx.Unlock()
+}
+
+func newLegacyPeerSet() *legacyPeerSet {
+	return &legacyPeerSet{peers: make(map[string]*legacyPeer)}
+}
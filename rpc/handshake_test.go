@@ -0,0 +1,161 @@
+package rpc
+
+import (
+	"io"
+	"io/ioutil"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/xinlaini/golibs/log"
+)
+
+func TestHandshakeEncoding(t *testing.T) {
+	version, caps, err := decodeHandshake(encodeHandshake(ProtocolVersion, CapChecksums))
+	if err != nil || version != ProtocolVersion || caps != CapChecksums {
+		t.Errorf("Decoded v%d with %s (error: %v), want v%d with %s",
+			version, caps, err, ProtocolVersion, CapChecksums)
+	}
+	if _, _, err = decodeHandshake(make([]byte, handshakeSize)); err != errBadMagic {
+		t.Errorf("Decoding zeros failed with %v, want %v", err, errBadMagic)
+	}
+	if _, _, err = decodeHandshake(encodeHandshake(0, 0)); err == nil {
+		t.Error("Decoded protocol version 0")
+	}
+	if got := (CapChecksums | CapMultiplexing).String(); got != "checksums,multiplexing" {
+		t.Errorf("Got capabilities %q", got)
+	}
+}
+
+// legacyDialer dials a server, or, given an answer func, a fake server running it.
+type legacyDialer struct {
+	l      *PipeListener
+	answer func(serverEnd net.Conn)
+	mtx    sync.Mutex
+}
+
+func (d *legacyDialer) dial(addr string) (net.Conn, error) {
+	d.mtx.Lock()
+	answer := d.answer
+	d.mtx.Unlock()
+	if answer == nil {
+		return d.l.Dial(addr)
+	}
+	clientEnd, serverEnd := net.Pipe()
+	go func() {
+		defer serverEnd.Close()
+		answer(serverEnd)
+	}()
+	return clientEnd, nil
+}
+
+func (d *legacyDialer) setAnswer(answer func(net.Conn)) {
+	d.mtx.Lock()
+	d.answer = answer
+	d.mtx.Unlock()
+}
+
+// Answers of servers predating the handshake: reading requests that never complete, closing
+// the connection or answering anything but a handshake.
+var (
+	stall = func(conn net.Conn) {
+		io.Copy(ioutil.Discard, conn)
+	}
+	hangUp = func(conn net.Conn) {
+		io.ReadFull(conn, make([]byte, handshakeSize))
+	}
+	answerOther = func(conn net.Conn) {
+		io.ReadFull(conn, make([]byte, handshakeSize))
+		conn.Write([]byte("HTTP/1.1 400 Bad Request"))
+	}
+)
+
+func newHandshakeTestClient(d *legacyDialer, mode HandshakeMode, timeout time.Duration) *Client {
+	return &Client{
+		logger:           xlog.NewNilLogger(),
+		serviceAddr:      "pipe",
+		dial:             d.dial,
+		handshakeMode:    mode,
+		handshakeTimeout: timeout,
+		legacyPeers:      newLegacyPeerSet(),
+		caps:             CapChecksums,
+	}
+}
+
+// expireFallback makes the fallback of c, if any, over.
+func expireFallback(c *Client) {
+	c.legacyPeers.mtx.Lock()
+	if peer, found := c.legacyPeers.peers[c.serviceAddr]; found {
+		peer.until = time.Now()
+	}
+	c.legacyPeers.mtx.Unlock()
+}
+
+func TestHandshakeFallback(t *testing.T) {
+	d := &legacyDialer{l: NewPipeListener(), answer: stall}
+	defer d.l.Close()
+	go newTestController(t).ServeListener(d.l)
+
+	if _, _, err := newHandshakeTestClient(d, HandshakeRequired, 20*time.Millisecond).dialProtocol(); err == nil {
+		t.Error("Required handshake succeeded with a server that doesn't answer")
+	}
+
+	c := newHandshakeTestClient(d, HandshakeAuto, 20*time.Millisecond)
+	for _, test := range []struct {
+		desc   string
+		answer func(net.Conn)
+		expire bool
+		want   Capabilities
+		// wantInterval is how long the fallback holds afterwards, 0 if none.
+		wantInterval time.Duration
+	}{
+		{"stalling server", stall, false, 0, legacyRetryInterval},
+		// The server would handshake now, but the fallback holds for a while.
+		{"during the fallback", nil, false, 0, legacyRetryInterval},
+		// Once it's over, the client tries again, and falls back for longer.
+		{"stalling server again", stall, true, 0, 2 * legacyRetryInterval},
+		// Then a successful handshake makes the client forget about the fallbacks.
+		{"upgraded server", nil, true, CapChecksums, 0},
+	} {
+		if test.expire {
+			expireFallback(c)
+		}
+		d.setAnswer(test.answer)
+		conn, caps, err := c.dialProtocol()
+		if err != nil {
+			t.Fatalf("%s: %s", test.desc, err)
+		}
+		conn.Close()
+		if caps != test.want {
+			t.Errorf("%s: got capabilities %s, want %s", test.desc, caps, test.want)
+		}
+		var interval time.Duration
+		if peer, found := c.legacyPeers.peers[c.serviceAddr]; found {
+			interval = peer.interval
+		}
+		if interval != test.wantInterval {
+			t.Errorf("%s: fallback holds for %s, want %s", test.desc, interval, test.wantInterval)
+		}
+	}
+}
+
+func TestHandshakeFallsBackWithoutWaiting(t *testing.T) {
+	for name, answer := range map[string]func(net.Conn){
+		"closed connection": hangUp,
+		"other answer":      answerOther,
+	} {
+		d := &legacyDialer{answer: answer}
+		// The timeout would fail the test if the client waited for it.
+		c := newHandshakeTestClient(d, HandshakeAuto, time.Minute)
+		conn, caps, err := c.dialProtocol()
+		if err != nil {
+			t.Errorf("%s: %s", name, err)
+			continue
+		}
+		conn.Close()
+		if caps != 0 || !c.legacyPeers.isLegacy(c.serviceAddr) {
+			t.Errorf("%s: got capabilities %s, without falling back", name, caps)
+		}
+	}
+}
@@ -0,0 +1,165 @@
+package rpc_test
+
+import (
+	"bytes"
+	"net"
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"gen/pb/rpc/rpc_proto"
+
+	"github.com/golang/protobuf/proto"
+	"golang.org/x/net/context"
+
+	"github.com/xinlaini/golibs/log"
+	"github.com/xinlaini/golibs/rpc"
+	"github.com/xinlaini/golibs/rpc/rpctest"
+)
+
+var (
+	kvType = reflect.TypeOf(rpc_proto.KeyValue{})
+)
+
+// kv is the message the tests send and receive.
+func kv(value string) *rpc_proto.KeyValue {
+	return &rpc_proto.KeyValue{Value: proto.String(value)}
+}
+
+// echoService echoes the raw request back.
+func echoService() rpc.ServiceConfig {
+	return rpc.ServiceConfig{Raw: func(ctx *rpc.ServerContext, requestPB []byte) ([]byte, error) {
+		return requestPB, nil
+	}}
+}
+
+// startPipeServer serves config over a pipe, and returns a client of serviceName to it.
+func startPipeServer(t *testing.T, config rpc.Config, serviceName string) (*rpctest.Server, *rpc.Client) {
+	s, err := rpctest.StartPipeServer(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := s.NewClient(serviceName)
+	if err != nil {
+		s.Close()
+		t.Fatal(err)
+	}
+	return s, c
+}
+
+// newCtx returns a client context whose deadline keeps a hung test from blocking forever.
+func newCtx() (*rpc.ClientContext, context.CancelFunc) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	return &rpc.ClientContext{Context: ctx}, cancel
+}
+
+// call calls methodName with kv(value), and returns the value of the response.
+func call(c *rpc.Client, ctx *rpc.ClientContext, methodName, value string) (string, error) {
+	if ctx == nil {
+		var cancel context.CancelFunc
+		ctx, cancel = newCtx()
+		defer cancel()
+	}
+	response, err := c.Call(methodName, ctx, kv(value), kvType)
+	if err != nil {
+		return "", err
+	}
+	return response.(*rpc_proto.KeyValue).GetValue(), nil
+}
+
+// countingListener counts the connections accepted by a PipeListener, the ones the server
+// closed, and the pings it answered.
+type countingListener struct {
+	*rpc.PipeListener
+	accepted int32
+	closed   int32
+	pings    int32
+}
+
+func (l *countingListener) Accept() (net.Conn, error) {
+	conn, err := l.PipeListener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	atomic.AddInt32(&l.accepted, 1)
+	return &countingConn{Conn: conn, l: l}, nil
+}
+
+func (l *countingListener) numAccepted() int {
+	return int(atomic.LoadInt32(&l.accepted))
+}
+
+func (l *countingListener) numClosed() int {
+	return int(atomic.LoadInt32(&l.closed))
+}
+
+func (l *countingListener) numPings() int {
+	return int(atomic.LoadInt32(&l.pings))
+}
+
+// countingConn is a server connection of a countingListener.
+type countingConn struct {
+	net.Conn
+	l         *countingListener
+	closeOnce sync.Once
+}
+
+func (conn *countingConn) Write(b []byte) (int, error) {
+	// Only the answer to a ping is an empty frame.
+	if bytes.Equal(b, []byte{0, 0, 0, 0}) {
+		atomic.AddInt32(&conn.l.pings, 1)
+	}
+	return conn.Conn.Write(b)
+}
+
+func (conn *countingConn) Close() error {
+	conn.closeOnce.Do(func() {
+		atomic.AddInt32(&conn.l.closed, 1)
+	})
+	return conn.Conn.Close()
+}
+
+// startCountingServer serves config over a countingListener, and returns client options for
+// serviceName to complete with the options under test.
+func startCountingServer(t *testing.T, config rpc.Config, serviceName string) (*countingListener, rpc.ClientOptions) {
+	if config.Logger == nil {
+		config.Logger = xlog.NewNilLogger()
+	}
+	ctrl, err := rpc.NewController(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l := &countingListener{PipeListener: rpc.NewPipeListener()}
+	go ctrl.ServeListener(l)
+	return l, rpc.ClientOptions{
+		ServiceName:  serviceName,
+		ServiceAddr:  l.Addr().String(),
+		ConnPoolSize: 1,
+		Retry:        rpctest.TestDialRetry,
+		Dial:         l.Dial,
+	}
+}
+
+func newClient(t *testing.T, opts rpc.ClientOptions) *rpc.Client {
+	ctrl, err := rpc.NewController(rpc.Config{Logger: xlog.NewNilLogger()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := ctrl.NewClient(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+// waitFor fails t unless cond becomes true within a few seconds.
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	for deadline := time.Now().Add(5 * time.Second); !cond(); time.Sleep(5 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("Timed out waiting for %s", what)
+		}
+	}
+}
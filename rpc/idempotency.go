@@ -0,0 +1,161 @@
+package rpc
+
+import (
+	"container/list"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"gen/pb/rpc/rpc_proto"
+
+	"github.com/golang/protobuf/proto"
+)
+
+const (
+	DefaultIdempotencyTTL = 10 * time.Minute
+)
+
+var (
+	// ErrIdempotencyKeyReused is returned by calls whose idempotency key was already used by a
+	// call with a different request.
+	ErrIdempotencyKeyReused = errors.New(serverPrefix + "Idempotency key was used with a different request")
+
+	requestSeq uint64
+)
+
+// newRequestID returns a random 128-bit ID, unique across hosts and concurrent calls.
+func newRequestID() string {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		// Fall back to something still unique within this process.
+		return fmt.Sprintf("%x-%x", time.Now().UnixNano(), atomic.AddUint64(&requestSeq, 1))
+	}
+	return hex.EncodeToString(id)
+}
+
+type idempotencyEntry struct {
+	key string
+	// requestHash tells the request of the first call with key from other requests reusing it.
+	requestHash [sha256.Size]byte
+	// done is closed when the first call with key finishes. response is then nil if that call
+	// timed out, or the response to replay otherwise.
+	done     chan struct{}
+	response *rpc_proto.Response
+	// waiters counts the calls that waited for done.
+	waiters   int
+	expiresAt time.Time
+	elem      *list.Element
+}
+
+// idempotencyCache remembers the responses of completed calls by idempotency key, so that a
+// retried call returns the original response instead of running again. It holds at most size
+// completed responses, for up to ttl each.
+type idempotencyCache struct {
+	size    int
+	ttl     time.Duration
+	entries map[string]*idempotencyEntry
+	// completed orders completed entries from oldest to newest.
+	completed *list.List
+	mtx       sync.Mutex
+}
+
+// serve runs the call received at the given time through run, unless a call with the same key
+// has completed or is in flight, in which case its response is replayed into response. A call
+// reusing the key with a different request fails instead. run returns false if the call
+// panicked or timed out, such calls aren't cached.
+func (cache *idempotencyCache) serve(
+	key string,
+	request []byte,
+	received time.Time,
+	timeout time.Duration,
+	response *rpc_proto.Response,
+	run func() bool) {
+	cache.mtx.Lock()
+	now := time.Now()
+	cache.evict(now)
+	requestHash := sha256.Sum256(request)
+	entry, found := cache.entries[key]
+	if !found {
+		entry = &idempotencyEntry{
+			key:         key,
+			requestHash: requestHash,
+			done:        make(chan struct{}),
+		}
+		cache.entries[key] = entry
+		cache.mtx.Unlock()
+
+		completed := run()
+
+		cache.mtx.Lock()
+		if completed {
+			entry.response = proto.Clone(response).(*rpc_proto.Response)
+			entry.expiresAt = time.Now().Add(cache.ttl)
+			entry.elem = cache.completed.PushBack(entry)
+		} else {
+			delete(cache.entries, key)
+		}
+		close(entry.done)
+		cache.evict(time.Now())
+		cache.mtx.Unlock()
+		return
+	}
+	if requestHash != entry.requestHash {
+		cache.mtx.Unlock()
+		response.Error = proto.String(ErrIdempotencyKeyReused.Error())
+		return
+	}
+	entry.waiters++
+	cache.mtx.Unlock()
+
+	// Wait for the call with the same key, within the deadline of this one.
+	var expired <-chan time.Time
+	if timeout > 0 {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		expired = timer.C
+	}
+	select {
+	case <-entry.done:
+	case <-expired:
+		response.Error = makeServerErr("Timed out waiting for the call with the same idempotency key")
+		return
+	}
+	if entry.response == nil {
+		response.Error = makeServerErr("The call with the same idempotency key did not complete")
+		return
+	}
+	response.Reset()
+	proto.Merge(response, entry.response)
+	// The timing of the original call says nothing about this one, which only waited for it.
+	respMeta := responseMetadata(response)
+	respMeta.QueueDelayUs = proto.Int64(int64(time.Now().Sub(received) / time.Microsecond))
+	respMeta.HandlerLatencyUs = nil
+	respMeta.AppliedTimeoutUs = nil
+	respMeta.Replayed = proto.Bool(true)
+}
+
+// evict drops expired entries, then the oldest ones beyond size. mtx must be held.
+func (cache *idempotencyCache) evict(now time.Time) {
+	for elem := cache.completed.Front(); elem != nil; elem = cache.completed.Front() {
+		entry := elem.Value.(*idempotencyEntry)
+		if cache.completed.Len() <= cache.size && now.Before(entry.expiresAt) {
+			return
+		}
+		cache.completed.Remove(elem)
+		delete(cache.entries, entry.key)
+	}
+}
+
+func newIdempotencyCache(size int, ttl time.Duration) *idempotencyCache {
+	return &idempotencyCache{
+		size:      size,
+		ttl:       ttl,
+		entries:   make(map[string]*idempotencyEntry),
+		completed: list.New(),
+	}
+}
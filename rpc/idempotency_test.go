@@ -0,0 +1,174 @@
+package rpc
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"gen/pb/rpc/rpc_proto"
+
+	"github.com/golang/protobuf/proto"
+)
+
+// serveCounting serves key through cache with a call that sets the response to value and
+// reports completed, counting the runs.
+func serveCounting(
+	cache *idempotencyCache, key, value string, completed bool, runs *int) *rpc_proto.Response {
+	response := &rpc_proto.Response{}
+	cache.serve(key, nil, time.Now(), time.Second, response, func() bool {
+		*runs++
+		response.ResponsePb = []byte(value)
+		response.Metadata = &rpc_proto.ResponseMetadata{
+			ServerJobName:    proto.String("job"),
+			QueueDelayUs:     proto.Int64(1),
+			HandlerLatencyUs: proto.Int64(2),
+			AppliedTimeoutUs: proto.Int64(3),
+		}
+		return completed
+	})
+	return response
+}
+
+// waitWaiters waits until n calls waited for the call with key in cache.
+func waitWaiters(t *testing.T, cache *idempotencyCache, key string, n int) {
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(time.Millisecond) {
+		cache.mtx.Lock()
+		waiters := cache.entries[key].waiters
+		cache.mtx.Unlock()
+		if waiters == n {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%d calls waited for '%s', want %d", waiters, key, n)
+		}
+	}
+}
+
+func TestIdempotencyReplay(t *testing.T) {
+	cache := newIdempotencyCache(10, time.Minute)
+	runs := 0
+	first := serveCounting(cache, "k", "first", true, &runs)
+	replayed := serveCounting(cache, "k", "second", true, &runs)
+	if runs != 1 {
+		t.Fatalf("Ran %d times, want 1", runs)
+	}
+	if string(replayed.ResponsePb) != "first" || !replayed.GetMetadata().GetReplayed() {
+		t.Errorf("Replayed response = %v", replayed)
+	}
+	if first.GetMetadata().GetReplayed() {
+		t.Error("Original response is marked replayed")
+	}
+	respMeta := replayed.GetMetadata()
+	if respMeta.GetServerJobName() != "job" {
+		t.Errorf("Replayed response lost its server job name: %v", respMeta)
+	}
+	if respMeta.HandlerLatencyUs != nil || respMeta.AppliedTimeoutUs != nil || respMeta.GetQueueDelayUs() == 1 {
+		t.Errorf("Replayed response kept the timing of the original call: %v", respMeta)
+	}
+
+	// Replays don't share the cached response.
+	replayed.ResponsePb[0] = 'X'
+	if replayed = serveCounting(cache, "k", "third", true, &runs); string(replayed.ResponsePb) != "first" {
+		t.Errorf("Replayed response = %q after modifying a replay", replayed.ResponsePb)
+	}
+}
+
+func TestIdempotencySkipsIncompleteCalls(t *testing.T) {
+	cache := newIdempotencyCache(10, time.Minute)
+	runs := 0
+	serveCounting(cache, "k", "panicked", false, &runs)
+	if response := serveCounting(cache, "k", "retried", true, &runs); string(response.ResponsePb) != "retried" {
+		t.Errorf("Retry of an incomplete call got %q", response.ResponsePb)
+	}
+	if runs != 2 {
+		t.Errorf("Ran %d times, want 2", runs)
+	}
+}
+
+func TestIdempotencyWaitsForCallInFlight(t *testing.T) {
+	cache := newIdempotencyCache(10, time.Minute)
+	started, finish := make(chan struct{}), make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		cache.serve("k", nil, time.Now(), time.Second, &rpc_proto.Response{}, func() bool {
+			close(started)
+			<-finish
+			return false
+		})
+	}()
+	<-started
+
+	response := &rpc_proto.Response{}
+	cache.serve("k", nil, time.Now(), 10*time.Millisecond, response, func() bool {
+		t.Error("Ran a call whose key is in flight")
+		return true
+	})
+	if response.Error == nil {
+		t.Error("Waiting past the deadline succeeded")
+	}
+
+	done := make(chan *rpc_proto.Response)
+	go func() {
+		response := &rpc_proto.Response{}
+		cache.serve("k", nil, time.Now(), time.Second, response, func() bool {
+			t.Error("Ran a call whose key is in flight")
+			return true
+		})
+		done <- response
+	}()
+	waitWaiters(t, cache, "k", 2)
+	close(finish)
+	if response := <-done; response.Error == nil {
+		t.Error("Waiting for an incomplete call succeeded")
+	}
+	wg.Wait()
+}
+
+func TestIdempotencyKeyReuse(t *testing.T) {
+	cache := newIdempotencyCache(10, time.Minute)
+	cache.serve("k", []byte("a"), time.Now(), time.Second, &rpc_proto.Response{}, func() bool {
+		return true
+	})
+	response := &rpc_proto.Response{}
+	cache.serve("k", []byte("b"), time.Now(), time.Second, response, func() bool {
+		t.Error("Ran a call reusing a key")
+		return true
+	})
+	if got := response.GetError(); got != ErrIdempotencyKeyReused.Error() {
+		t.Errorf("Call reusing a key failed with %q, want %q", got, ErrIdempotencyKeyReused)
+	}
+}
+
+func TestIdempotencyEviction(t *testing.T) {
+	cache := newIdempotencyCache(2, time.Minute)
+	runs := 0
+	for _, key := range []string{"a", "b", "c", "a"} {
+		serveCounting(cache, key, key, true, &runs)
+	}
+	// "a" was evicted by "c", and ran again.
+	if runs != 4 {
+		t.Errorf("Ran %d times, want 4", runs)
+	}
+
+	cache = newIdempotencyCache(2, time.Minute)
+	runs = 0
+	serveCounting(cache, "a", "a", true, &runs)
+	cache.entries["a"].expiresAt = time.Now()
+	serveCounting(cache, "a", "a", true, &runs)
+	if runs != 2 {
+		t.Errorf("Ran %d times across the TTL, want 2", runs)
+	}
+}
+
+func TestNewRequestID(t *testing.T) {
+	seen := make(map[string]bool)
+	for i := 0; i < 1000; i++ {
+		id := newRequestID()
+		if len(id) != 32 || seen[id] {
+			t.Fatalf("Request ID %q is malformed or reused", id)
+		}
+		seen[id] = true
+	}
+}
@@ -0,0 +1,124 @@
+package rpc
+
+import (
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"net"
+	"time"
+)
+
+const (
+	DefaultKeepaliveTimeout = 20 * time.Second
+)
+
+var (
+	// pingFrame is a frame with an empty payload. It is never a valid request, so the server
+	// answers it with an empty frame of its own instead of dispatching it to a service.
+	pingFrame = []byte{0, 0, 0, 0}
+)
+
+func (c *Client) maintainLoop(opts *ClientOptions) {
+	tick := maintenanceTick(opts)
+	if tick == 0 {
+		return
+	}
+	defer c.logger.Infof("Quitting maintainLoop for remote address '%s'", c.serviceAddr)
+
+	ticker := time.NewTicker(tick)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-c.closed:
+			return
+		case <-ticker.C:
+			c.maintainIdleConns(opts)
+		}
+	}
+}
+
+// maintainIdleConns shrinks the pool, or pings, reaps or rotates the connections currently
+// sitting in the pool. Each one is taken out of the pool while it's being checked, so it can't
+// race with a call.
+func (c *Client) maintainIdleConns(opts *ClientOptions) {
+	for n := len(c.freeConns); n > 0; n-- {
+		var entry *connEntry
+		select {
+		case entry = <-c.freeConns:
+		default:
+			return
+		}
+
+		now := time.Now()
+		c.mtxEntries.RLock()
+		idleSince := entry.idleSince
+		lastTraffic := idleSince
+		if entry.pingedSince.After(lastTraffic) {
+			lastTraffic = entry.pingedSince
+		}
+		c.mtxEntries.RUnlock()
+
+		if opts.PoolShrinkIdleTime > 0 && now.Sub(idleSince) > opts.PoolShrinkIdleTime && c.retire(entry) {
+			c.logger.Infof(
+				"Connection from local port '%s' to '%s' has been idle for %s, shrinking pool...",
+				entry.localPort, c.serviceAddr, now.Sub(idleSince).String())
+			continue
+		}
+		if opts.MaxIdleTime > 0 && now.Sub(idleSince) > opts.MaxIdleTime {
+			c.logger.Infof(
+				"Connection from local port '%s' to '%s' has been idle for %s, replacing...",
+				entry.localPort, c.serviceAddr, now.Sub(idleSince).String())
+			c.discard(entry)
+			continue
+		}
+		if entry.expired(now) {
+			c.logger.Infof(
+				"Connection from local port '%s' to '%s' reached its max age, rotating...",
+				entry.localPort, c.serviceAddr)
+			c.discard(entry)
+			continue
+		}
+		if opts.KeepaliveInterval > 0 && now.Sub(lastTraffic) >= opts.KeepaliveInterval {
+			if err := ping(entry.conn, opts.KeepaliveTimeout); err != nil {
+				c.logger.Errorf(
+					"Ping from local port '%s' to '%s' failed (error: %s), discarding...",
+					entry.localPort, c.serviceAddr, err)
+				c.discard(entry)
+				continue
+			}
+			c.mtxEntries.Lock()
+			entry.pingedSince = time.Now()
+			c.mtxEntries.Unlock()
+		}
+		c.freeConns <- entry
+	}
+}
+
+// maintenanceTick returns how often maintainLoop checks the pool, 0 if it has nothing to do.
+func maintenanceTick(opts *ClientOptions) time.Duration {
+	var tick time.Duration
+	for _, d := range []time.Duration{opts.KeepaliveInterval, opts.MaxIdleTime, opts.MaxConnectionAge, opts.PoolShrinkIdleTime} {
+		if d > 0 && (tick == 0 || d < tick) {
+			tick = d
+		}
+	}
+	return tick / 2
+}
+
+func ping(conn net.Conn, timeout time.Duration) error {
+	var err error
+	if err = conn.SetDeadline(time.Now().Add(timeout)); err != nil {
+		return err
+	}
+	if _, err = conn.Write(pingFrame); err != nil {
+		return err
+	}
+	sizeBuf := [4]byte{}
+	if _, err = io.ReadFull(conn, sizeBuf[:]); err != nil {
+		return err
+	}
+	// A server predating pings answers with an error response rather than an empty frame,
+	// which proves the connection alive just as well.
+	_, err = io.CopyN(ioutil.Discard, conn, int64(binary.BigEndian.Uint32(sizeBuf[:])))
+	return err
+}
@@ -0,0 +1,100 @@
+package rpc_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/xinlaini/golibs/rpc"
+)
+
+func TestKeepaliveKeepsIdleConnOpen(t *testing.T) {
+	l, opts := startCountingServer(t, rpc.Config{
+		Services:        map[string]rpc.ServiceConfig{"Echo": echoService()},
+		ConnIdleTimeout: 100 * time.Millisecond,
+	}, "Echo")
+	defer l.Close()
+	opts.KeepaliveInterval = 20 * time.Millisecond
+	c := newClient(t, opts)
+	defer c.Close()
+
+	if _, err := call(c, nil, "Echo", "a"); err != nil {
+		t.Fatal(err)
+	}
+	// Pings keep the connection open well past ConnIdleTimeout.
+	waitFor(t, "pings", func() bool {
+		return l.numPings() >= 10
+	})
+	if _, err := call(c, nil, "Echo", "b"); err != nil {
+		t.Fatal(err)
+	}
+	if n := l.numAccepted(); n != 1 {
+		t.Errorf("Server accepted %d connections, want 1", n)
+	}
+}
+
+func TestServerClosesIdleConns(t *testing.T) {
+	l, opts := startCountingServer(t, rpc.Config{
+		Services:        map[string]rpc.ServiceConfig{"Echo": echoService()},
+		ConnIdleTimeout: 50 * time.Millisecond,
+	}, "Echo")
+	defer l.Close()
+	c := newClient(t, opts)
+	defer c.Close()
+
+	if _, err := call(c, nil, "Echo", "a"); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "the server to close the idle connection", func() bool {
+		return l.numClosed() == 1
+	})
+	// The first call finds the connection closed by the server and discards it.
+	waitFor(t, "a call over a new connection", func() bool {
+		_, err := call(c, nil, "Echo", "b")
+		return err == nil
+	})
+	if n := l.numAccepted(); n != 2 {
+		t.Errorf("Server accepted %d connections, want 2", n)
+	}
+}
+
+func TestMaxIdleTimeReplacesIdleConns(t *testing.T) {
+	l, opts := startCountingServer(t, rpc.Config{
+		Services: map[string]rpc.ServiceConfig{"Echo": echoService()},
+	}, "Echo")
+	defer l.Close()
+	opts.MaxIdleTime = 30 * time.Millisecond
+	c := newClient(t, opts)
+	defer c.Close()
+
+	// The pool is fixed, yet its idle connection is replaced, repeatedly.
+	waitFor(t, "idle connections to be replaced", func() bool {
+		return l.numAccepted() >= 3
+	})
+	if _, err := call(c, nil, "Echo", "a"); err != nil {
+		t.Fatal(err)
+	}
+	if stats := c.Stats(); stats.PoolSize != 1 || stats.Shrunk != 0 {
+		t.Errorf("Stats() = %+v after replacements, want PoolSize 1 and Shrunk 0", stats)
+	}
+}
+
+func TestMaxConnectionAgeRotatesConns(t *testing.T) {
+	l, opts := startCountingServer(t, rpc.Config{
+		Services: map[string]rpc.ServiceConfig{"Echo": echoService()},
+	}, "Echo")
+	defer l.Close()
+	opts.MaxConnectionAge = 30 * time.Millisecond
+	opts.MaxConnectionAgeJitter = -1
+	c := newClient(t, opts)
+	defer c.Close()
+
+	waitFor(t, "connections to be rotated", func() bool {
+		return l.numAccepted() >= 3
+	})
+	if _, err := call(c, nil, "Echo", "a"); err != nil {
+		t.Fatal(err)
+	}
+	if size := c.Stats().PoolSize; size != 1 {
+		t.Errorf("PoolSize = %d after rotations, want 1", size)
+	}
+}
@@ -0,0 +1,96 @@
+package rpc
+
+import (
+	"sort"
+	"strings"
+	"time"
+
+	"gen/pb/rpc/rpc_proto"
+
+	"github.com/golang/protobuf/proto"
+)
+
+const (
+	// BinaryKeySuffix marks MD keys whose values are arbitrary bytes rather than text.
+	BinaryKeySuffix = "-bin"
+)
+
+// MD is custom metadata attached to requests and responses, e.g. a locale or a tenant. Values
+// of keys ending in BinaryKeySuffix may hold arbitrary bytes, the others should be text.
+type MD map[string]string
+
+// SetBinary sets a binary value, appending BinaryKeySuffix to key if missing.
+func (md MD) SetBinary(key string, value []byte) {
+	if !strings.HasSuffix(key, BinaryKeySuffix) {
+		key += BinaryKeySuffix
+	}
+	md[key] = string(value)
+}
+
+// GetBinary gets a binary value, appending BinaryKeySuffix to key if missing.
+func (md MD) GetBinary(key string) ([]byte, bool) {
+	if !strings.HasSuffix(key, BinaryKeySuffix) {
+		key += BinaryKeySuffix
+	}
+	value, found := md[key]
+	if !found {
+		return nil, false
+	}
+	return []byte(value), true
+}
+
+// mdToPB converts md to its wire form, sorted by key so that equal MDs serialize equally.
+func mdToPB(md MD) []*rpc_proto.KeyValue {
+	if len(md) == 0 {
+		return nil
+	}
+	keys := make([]string, 0, len(md))
+	for key := range md {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	kvs := make([]*rpc_proto.KeyValue, 0, len(keys))
+	for _, key := range keys {
+		kv := &rpc_proto.KeyValue{Key: proto.String(key)}
+		if strings.HasSuffix(key, BinaryKeySuffix) {
+			kv.BinaryValue = []byte(md[key])
+		} else {
+			kv.Value = proto.String(md[key])
+		}
+		kvs = append(kvs, kv)
+	}
+	return kvs
+}
+
+func mdFromPB(kvs []*rpc_proto.KeyValue) MD {
+	md := make(MD, len(kvs))
+	for _, kv := range kvs {
+		if strings.HasSuffix(kv.GetKey(), BinaryKeySuffix) {
+			md[kv.GetKey()] = string(kv.GetBinaryValue())
+		} else {
+			md[kv.GetKey()] = kv.GetValue()
+		}
+	}
+	return md
+}
+
+// setResponseMD copies the response headers and trailers set by a method handler.
+func setResponseMD(ctx *ServerContext, response *rpc_proto.Response) {
+	if ctx.CacheMaxAge > 0 {
+		responseMetadata(response).CacheMaxAgeUs = proto.Int64(int64(ctx.CacheMaxAge / time.Microsecond))
+	}
+	if len(ctx.ResponseHeader) == 0 && len(ctx.ResponseTrailer) == 0 {
+		return
+	}
+	respMeta := responseMetadata(response)
+	respMeta.Headers = mdToPB(ctx.ResponseHeader)
+	respMeta.Trailers = mdToPB(ctx.ResponseTrailer)
+}
+
+func responseMetadata(response *rpc_proto.Response) *rpc_proto.ResponseMetadata {
+	if response.Metadata == nil {
+		response.Metadata = &rpc_proto.ResponseMetadata{}
+	}
+	return response.Metadata
+}
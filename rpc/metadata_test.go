@@ -0,0 +1,76 @@
+package rpc_test
+
+import (
+	"bytes"
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/xinlaini/golibs/rpc"
+)
+
+func TestMDBinary(t *testing.T) {
+	md := rpc.MD{}
+	value := []byte{0, 1, 0xff}
+	md.SetBinary("trace", value)
+	if _, found := md["trace"]; found {
+		t.Error("SetBinary() didn't append the binary suffix")
+	}
+	for _, key := range []string{"trace", "trace" + rpc.BinaryKeySuffix} {
+		if got, found := md.GetBinary(key); !found || !bytes.Equal(got, value) {
+			t.Errorf("GetBinary(%q) = %v, %t, want %v", key, got, found, value)
+		}
+	}
+	if _, found := md.GetBinary("missing"); found {
+		t.Error("GetBinary() found a missing key")
+	}
+}
+
+func TestMDRoundTrip(t *testing.T) {
+	received := make(chan rpc.MD, 1)
+	s, c := startPipeServer(t, rpc.Config{
+		Services: map[string]rpc.ServiceConfig{
+			"MD": {Raw: func(ctx *rpc.ServerContext, requestPB []byte) ([]byte, error) {
+				received <- ctx.RequestHeader
+				ctx.ResponseHeader["locale"] = ctx.RequestHeader["locale"]
+				ctx.ResponseTrailer.SetBinary("cost", []byte{42})
+				if ctx.Metadata.GetMethodName() == "Fail" {
+					return nil, errors.New("Failed")
+				}
+				return requestPB, nil
+			}},
+		},
+	}, "MD")
+	defer s.Close()
+	defer c.Close()
+
+	header := rpc.MD{"locale": "fr", "tenant": "t1"}
+	header.SetBinary("token", []byte{0, 0xff})
+	for _, methodName := range []string{"Get", "Fail"} {
+		ctx, cancel := newCtx()
+		ctx.RequestHeader = header
+		_, err := call(c, ctx, methodName, "a")
+		cancel()
+		if (err != nil) != (methodName == "Fail") {
+			t.Errorf("%s failed with %v", methodName, err)
+		}
+		if got := <-received; !reflect.DeepEqual(got, header) {
+			t.Errorf("%s got request header %v, want %v", methodName, got, header)
+		}
+		if got := ctx.ResponseHeader; !reflect.DeepEqual(got, rpc.MD{"locale": "fr"}) {
+			t.Errorf("%s got response header %v", methodName, got)
+		}
+		if got, _ := ctx.ResponseTrailer.GetBinary("cost"); !bytes.Equal(got, []byte{42}) {
+			t.Errorf("%s got response trailer %v", methodName, ctx.ResponseTrailer)
+		}
+	}
+
+	ctx, cancel := newCtx()
+	defer cancel()
+	if _, err := call(c, ctx, "Get", "a"); err != nil {
+		t.Fatal(err)
+	}
+	if got := <-received; len(got) != 0 {
+		t.Errorf("Got request header %v, want none", got)
+	}
+}
@@ -0,0 +1,314 @@
+package rpc
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"math/rand"
+	"reflect"
+	"sync"
+	"time"
+
+	"gen/pb/rpc/rpc_proto"
+
+	"golang.org/x/net/context"
+
+	"github.com/golang/protobuf/proto"
+)
+
+const (
+	DefaultMirrorTimeout     = 10 * time.Second
+	DefaultMirrorMaxInFlight = 100
+	DefaultMirrorMaxDiffs    = 100
+)
+
+// MirrorOptions copy a fraction of the calls of a Client to a shadow backend, e.g. a new
+// version of the service, and record where its responses differ from the primary ones.
+type MirrorOptions struct {
+	Addr string
+	// Methods lists the methods mirrored, by name. Only list methods that are safe to call
+	// twice, since the shadow serves the calls for real.
+	Methods []string
+	// Fraction of the calls mirrored, in (0, 1].
+	Fraction float64
+	// Timeout bounds each mirrored call, defaults to DefaultMirrorTimeout.
+	Timeout time.Duration
+	// MaxInFlight bounds the mirrored calls in flight, beyond which calls aren't mirrored.
+	// Defaults to DefaultMirrorMaxInFlight.
+	MaxInFlight int
+	// MaxDiffs is how many of the most recent diffs are kept, defaults to
+	// DefaultMirrorMaxDiffs.
+	MaxDiffs int
+}
+
+// MirrorDiff is a call whose primary and shadow results differ.
+type MirrorDiff struct {
+	Time       time.Time
+	MethodName string
+	Flags      uint32
+	RequestPb  []byte
+	// The responses are nil if the calls failed with the errors, or returned nil.
+	PrimaryResponsePb []byte
+	ShadowResponsePb  []byte
+	PrimaryError      string
+	ShadowError       string
+	// ByteOffset is the first offset where the responses differ, or -1 if only the errors do.
+	ByteOffset int
+}
+
+// FieldDiffs decodes both responses as messages of the type of pb, and returns the paths of
+// the fields that differ, e.g. "Hdr.Body".
+func (diff *MirrorDiff) FieldDiffs(pb proto.Message) ([]string, error) {
+	primary := reflect.New(reflect.TypeOf(pb).Elem()).Interface().(proto.Message)
+	shadow := reflect.New(reflect.TypeOf(pb).Elem()).Interface().(proto.Message)
+	for _, r := range []struct {
+		pb    proto.Message
+		bytes []byte
+	}{{primary, diff.PrimaryResponsePb}, {shadow, diff.ShadowResponsePb}} {
+		var err error
+		if diff.Flags&uint32(rpc_proto.Flag_TEXT_PB_PAYLOAD) != 0 {
+			err = proto.UnmarshalText(string(r.bytes), r.pb)
+		} else {
+			err = proto.Unmarshal(r.bytes, r.pb)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return fieldDiffs("", reflect.ValueOf(primary).Elem(), reflect.ValueOf(shadow).Elem()), nil
+}
+
+func fieldDiffs(path string, a, b reflect.Value) []string {
+	switch a.Kind() {
+	case reflect.Ptr:
+		if a.IsNil() || b.IsNil() {
+			if a.IsNil() != b.IsNil() {
+				return []string{path}
+			}
+			return nil
+		}
+		return fieldDiffs(path, a.Elem(), b.Elem())
+	case reflect.Struct:
+		var diffs []string
+		for i := 0; i < a.NumField(); i++ {
+			field := a.Type().Field(i)
+			if field.PkgPath != "" || field.Name == "XXX_unrecognized" {
+				continue
+			}
+			fieldPath := field.Name
+			if path != "" {
+				fieldPath = path + "." + field.Name
+			}
+			diffs = append(diffs, fieldDiffs(fieldPath, a.Field(i), b.Field(i))...)
+		}
+		return diffs
+	case reflect.Slice:
+		if a.Type().Elem().Kind() == reflect.Uint8 || a.Len() != b.Len() {
+			if !reflect.DeepEqual(a.Interface(), b.Interface()) {
+				return []string{path}
+			}
+			return nil
+		}
+		var diffs []string
+		for i := 0; i < a.Len(); i++ {
+			diffs = append(diffs, fieldDiffs(fmt.Sprintf("%s[%d]", path, i), a.Index(i), b.Index(i))...)
+		}
+		return diffs
+	}
+	if !reflect.DeepEqual(a.Interface(), b.Interface()) {
+		return []string{path}
+	}
+	return nil
+}
+
+// MirrorStats counts the calls of a Client considered for mirroring.
+type MirrorStats struct {
+	Mirrored int64
+	Matched  int64
+	Differed int64
+	// Skipped counts the calls not mirrored because MaxInFlight were in flight.
+	Skipped int64
+}
+
+type mirror struct {
+	shadow      *Client
+	methods     map[string]bool
+	fraction    float64
+	timeout     time.Duration
+	maxInFlight int
+	maxDiffs    int
+
+	inFlight int
+	closed   bool
+	rnd      *rand.Rand
+	stats    MirrorStats
+	diffs    []MirrorDiff
+	wg       sync.WaitGroup
+	mtx      sync.Mutex
+}
+
+// start mirrors the call if its method is mirrored and it's sampled, comparing the shadow
+// result with the primary one in the background.
+func (m *mirror) start(
+	methodName string,
+	ctx *ClientContext,
+	requestPB []byte,
+	flags uint32,
+	primaryPB []byte,
+	primaryErr error) {
+	if !m.methods[methodName] {
+		return
+	}
+	m.mtx.Lock()
+	if m.closed || m.rnd.Float64() >= m.fraction {
+		m.mtx.Unlock()
+		return
+	}
+	if m.inFlight >= m.maxInFlight {
+		m.stats.Skipped++
+		m.mtx.Unlock()
+		return
+	}
+	m.inFlight++
+	m.wg.Add(1)
+	m.mtx.Unlock()
+
+	// The idempotency key isn't forwarded, the shadow must serve the call even if the primary
+	// replayed it.
+	shadowCtx := &ClientContext{
+		Priority:      ctx.Priority,
+		RequestHeader: ctx.RequestHeader,
+		BypassCache:   true,
+	}
+	go func() {
+		defer m.wg.Done()
+		var cancel context.CancelFunc
+		shadowCtx.Context, cancel = context.WithTimeout(context.Background(), m.timeout)
+		shadowPB, shadowErr := m.shadow.callInternal(methodName, shadowCtx, requestPB, flags)
+		cancel()
+		m.compare(methodName, requestPB, flags, primaryPB, primaryErr, shadowPB, shadowErr)
+	}()
+}
+
+func (m *mirror) compare(
+	methodName string,
+	requestPB []byte,
+	flags uint32,
+	primaryPB []byte,
+	primaryErr error,
+	shadowPB []byte,
+	shadowErr error) {
+	diff := MirrorDiff{
+		MethodName:        methodName,
+		Flags:             flags,
+		RequestPb:         requestPB,
+		PrimaryResponsePb: primaryPB,
+		ShadowResponsePb:  shadowPB,
+		ByteOffset:        -1,
+	}
+	if primaryErr != nil {
+		diff.PrimaryError = primaryErr.Error()
+	}
+	if shadowErr != nil {
+		diff.ShadowError = shadowErr.Error()
+	}
+	if !bytes.Equal(primaryPB, shadowPB) {
+		diff.ByteOffset = 0
+		for diff.ByteOffset < len(primaryPB) && diff.ByteOffset < len(shadowPB) &&
+			primaryPB[diff.ByteOffset] == shadowPB[diff.ByteOffset] {
+			diff.ByteOffset++
+		}
+	}
+
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	m.inFlight--
+	m.stats.Mirrored++
+	if diff.ByteOffset < 0 && diff.PrimaryError == diff.ShadowError {
+		m.stats.Matched++
+		return
+	}
+	m.stats.Differed++
+	diff.Time = time.Now()
+	if len(m.diffs) == m.maxDiffs {
+		m.diffs = m.diffs[1:]
+	}
+	m.diffs = append(m.diffs, diff)
+}
+
+func (m *mirror) close() {
+	// No call starts once closed is set, so that Wait doesn't race with Add.
+	m.mtx.Lock()
+	m.closed = true
+	m.mtx.Unlock()
+	m.wg.Wait()
+	m.shadow.Close()
+}
+
+// MirrorStats returns the mirroring stats, all zero if the Client doesn't mirror.
+func (c *Client) MirrorStats() MirrorStats {
+	if c.mirror == nil {
+		return MirrorStats{}
+	}
+	c.mirror.mtx.Lock()
+	defer c.mirror.mtx.Unlock()
+	return c.mirror.stats
+}
+
+// MirrorDiffs returns the most recent calls whose shadow results differ, oldest first.
+func (c *Client) MirrorDiffs() []MirrorDiff {
+	if c.mirror == nil {
+		return nil
+	}
+	c.mirror.mtx.Lock()
+	defer c.mirror.mtx.Unlock()
+	return append([]MirrorDiff(nil), c.mirror.diffs...)
+}
+
+func newMirror(ctrl *Controller, opts *ClientOptions) (*mirror, error) {
+	mopts := opts.Mirror
+	if mopts.Addr == "" {
+		return nil, errors.New("ClientOptions.Mirror.Addr must be set")
+	}
+	if len(mopts.Methods) == 0 {
+		return nil, errors.New("ClientOptions.Mirror.Methods must not be empty")
+	}
+	if mopts.Fraction <= 0 || mopts.Fraction > 1 {
+		return nil, errors.New("ClientOptions.Mirror.Fraction must be in (0, 1]")
+	}
+	if mopts.Timeout < 0 || mopts.MaxInFlight < 0 || mopts.MaxDiffs < 0 {
+		return nil, errors.New("ClientOptions.Mirror.Timeout, MaxInFlight and MaxDiffs must be >=0")
+	}
+	m := &mirror{
+		methods:     make(map[string]bool),
+		fraction:    mopts.Fraction,
+		timeout:     mopts.Timeout,
+		maxInFlight: mopts.MaxInFlight,
+		maxDiffs:    mopts.MaxDiffs,
+		rnd:         rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+	for _, methodName := range mopts.Methods {
+		m.methods[methodName] = true
+	}
+	if m.timeout == 0 {
+		m.timeout = DefaultMirrorTimeout
+	}
+	if m.maxInFlight == 0 {
+		m.maxInFlight = DefaultMirrorMaxInFlight
+	}
+	if m.maxDiffs == 0 {
+		m.maxDiffs = DefaultMirrorMaxDiffs
+	}
+
+	shadowOpts := *opts
+	shadowOpts.ServiceAddr = mopts.Addr
+	shadowOpts.Mirror = nil
+	shadowOpts.ResponseCacheSize = 0
+	var err error
+	if m.shadow, err = newClient(ctrl, &shadowOpts); err != nil {
+		return nil, err
+	}
+	// The fault rules of ctrl target the primary backend, not the shadow.
+	m.shadow.faults = newFaultInjector()
+	return m, nil
+}
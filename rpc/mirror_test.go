@@ -0,0 +1,130 @@
+package rpc_test
+
+import (
+	"net"
+	"reflect"
+	"sync"
+	"testing"
+
+	"github.com/golang/protobuf/proto"
+
+	"github.com/xinlaini/golibs/log"
+	"github.com/xinlaini/golibs/rpc"
+)
+
+// shadowCalls records the calls served by a shadow backend.
+type shadowCalls struct {
+	methodNames     []string
+	idempotencyKeys []string
+	mtx             sync.Mutex
+}
+
+// startMirroredServers serves an echo service as the primary backend, and as the shadow
+// backend at the address "shadow", except that the shadow answers Diff differently. It returns
+// options for a client of the primary that mirrors methodNames to the shadow.
+func startMirroredServers(
+	t *testing.T, calls *shadowCalls, methodNames ...string) (*countingListener, rpc.ClientOptions) {
+	primary, opts := startCountingServer(t, rpc.Config{
+		Services: map[string]rpc.ServiceConfig{"Echo": echoService()},
+	}, "Echo")
+	shadow, _ := startCountingServer(t, rpc.Config{
+		Services: map[string]rpc.ServiceConfig{
+			"Echo": {Raw: func(ctx *rpc.ServerContext, requestPB []byte) ([]byte, error) {
+				calls.mtx.Lock()
+				calls.methodNames = append(calls.methodNames, ctx.Metadata.GetMethodName())
+				calls.idempotencyKeys = append(calls.idempotencyKeys, ctx.Metadata.GetIdempotencyKey())
+				calls.mtx.Unlock()
+				if ctx.Metadata.GetMethodName() == "Diff" {
+					return proto.Marshal(kv("shadow"))
+				}
+				return requestPB, nil
+			}},
+		},
+	}, "Echo")
+	opts.Dial = func(addr string) (net.Conn, error) {
+		if addr == "shadow" {
+			return shadow.Dial(addr)
+		}
+		return primary.Dial(addr)
+	}
+	opts.Mirror = &rpc.MirrorOptions{Addr: "shadow", Methods: methodNames, Fraction: 1}
+	return primary, opts
+}
+
+func TestMirror(t *testing.T) {
+	var calls shadowCalls
+	l, opts := startMirroredServers(t, &calls, "Get", "Diff")
+	defer l.Close()
+	c := newClient(t, opts)
+
+	ctx, cancel := newCtx()
+	defer cancel()
+	ctx.IdempotencyKey = "key"
+	for _, methodName := range []string{"Get", "Diff", "Put"} {
+		if _, err := call(c, ctx, methodName, "a"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Closing waits for the mirrored calls.
+	c.Close()
+
+	if want := []string{"Get", "Diff"}; !reflect.DeepEqual(calls.methodNames, want) {
+		t.Errorf("Shadow served %v, want %v", calls.methodNames, want)
+	}
+	if want := []string{"", ""}; !reflect.DeepEqual(calls.idempotencyKeys, want) {
+		t.Errorf("Shadow got idempotency keys %q, want none", calls.idempotencyKeys)
+	}
+	if got, want := c.MirrorStats(), (rpc.MirrorStats{Mirrored: 2, Matched: 1, Differed: 1}); got != want {
+		t.Errorf("Got stats %+v, want %+v", got, want)
+	}
+	diffs := c.MirrorDiffs()
+	if len(diffs) != 1 || diffs[0].MethodName != "Diff" {
+		t.Fatalf("Got diffs %+v, want one of Diff", diffs)
+	}
+	fields, err := diffs[0].FieldDiffs(kv(""))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"Value"}; !reflect.DeepEqual(fields, want) {
+		t.Errorf("Got field diffs %v, want %v", fields, want)
+	}
+}
+
+func TestMirrorRequiresMethods(t *testing.T) {
+	var calls shadowCalls
+	l, opts := startMirroredServers(t, &calls)
+	defer l.Close()
+	ctrl, err := rpc.NewController(rpc.Config{Logger: xlog.NewNilLogger()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ctrl.NewClient(opts); err == nil {
+		t.Error("NewClient accepted a mirror without methods")
+	}
+}
+
+func TestMirrorCloseDuringCalls(t *testing.T) {
+	var calls shadowCalls
+	l, opts := startMirroredServers(t, &calls, "Get")
+	defer l.Close()
+	c := newClient(t, opts)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				// Calls fail once the client is closed.
+				if _, err := call(c, nil, "Get", "a"); err != nil {
+					return
+				}
+			}
+		}()
+	}
+	waitFor(t, "a mirrored call", func() bool {
+		return c.MirrorStats().Mirrored > 0
+	})
+	c.Close()
+	wg.Wait()
+}
@@ -0,0 +1,116 @@
+package rpc
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+var (
+	errPipeListenerClosed = errors.New("Pipe listener is closed")
+	errPipeNotAccepted    = errors.New("Pipe listener is not accepting connections")
+
+	// pipeDialTimeout bounds Dial, for a listener whose Accept loop is not running.
+	pipeDialTimeout = 5 * time.Second
+)
+
+type pipeAddr string
+
+func (a pipeAddr) Network() string {
+	return "pipe"
+}
+
+func (a pipeAddr) String() string {
+	return string(a)
+}
+
+// pipeConn gives each end of a net.Pipe a distinct address, so that a Client can key its
+// connection pool by local port just as it does for TCP.
+type pipeConn struct {
+	net.Conn
+	localAddr  net.Addr
+	remoteAddr net.Addr
+}
+
+func (c *pipeConn) LocalAddr() net.Addr {
+	return c.localAddr
+}
+
+func (c *pipeConn) RemoteAddr() net.Addr {
+	return c.remoteAddr
+}
+
+// PipeListener is an in-memory transport. Connections created by Dial are delivered to
+// Accept over net.Pipe, so a Controller and a Client can talk without opening any port:
+//
+//	l := rpc.NewPipeListener()
+//	go ctrl.ServeListener(l)
+//	client, err := ctrl.NewClient(rpc.ClientOptions{..., Dial: l.Dial})
+type PipeListener struct {
+	conns     chan net.Conn
+	closed    chan struct{}
+	closeOnce sync.Once
+	nextPort  uint32
+}
+
+func (l *PipeListener) Accept() (net.Conn, error) {
+	select {
+	case <-l.closed:
+		return nil, errPipeListenerClosed
+	case conn := <-l.conns:
+		return conn, nil
+	}
+}
+
+func (l *PipeListener) Close() error {
+	l.closeOnce.Do(func() {
+		close(l.closed)
+	})
+	return nil
+}
+
+func (l *PipeListener) Addr() net.Addr {
+	return pipeAddr("pipe:0")
+}
+
+// Dial connects to the listener, addr is ignored. It has the signature of DialFunc. It fails if
+// the connection is not accepted within a few seconds.
+func (l *PipeListener) Dial(addr string) (net.Conn, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), pipeDialTimeout)
+	defer cancel()
+	return l.DialContext(ctx, addr)
+}
+
+// DialContext is like Dial, but waits for the connection to be accepted until ctx is done, as
+// net.Dialer.DialContext does.
+func (l *PipeListener) DialContext(ctx context.Context, addr string) (net.Conn, error) {
+	clientAddr := pipeAddr(fmt.Sprintf("pipe:%d", atomic.AddUint32(&l.nextPort, 1)))
+	clientEnd, serverEnd := net.Pipe()
+	select {
+	case <-l.closed:
+		clientEnd.Close()
+		serverEnd.Close()
+		return nil, errPipeListenerClosed
+	case <-ctx.Done():
+		clientEnd.Close()
+		serverEnd.Close()
+		if ctx.Err() == context.DeadlineExceeded {
+			return nil, errPipeNotAccepted
+		}
+		return nil, ctx.Err()
+	case l.conns <- &pipeConn{Conn: serverEnd, localAddr: l.Addr(), remoteAddr: clientAddr}:
+		return &pipeConn{Conn: clientEnd, localAddr: clientAddr, remoteAddr: l.Addr()}, nil
+	}
+}
+
+func NewPipeListener() *PipeListener {
+	return &PipeListener{
+		conns:  make(chan net.Conn),
+		closed: make(chan struct{}),
+	}
+}
@@ -0,0 +1,96 @@
+package rpc_test
+
+import (
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/xinlaini/golibs/rpc"
+)
+
+func TestPipeCall(t *testing.T) {
+	s, c := startPipeServer(t, rpc.Config{
+		Services: map[string]rpc.ServiceConfig{"Echo": echoService()},
+	}, "Echo")
+	defer s.Close()
+	defer c.Close()
+
+	for _, value := range []string{"a", "b", ""} {
+		got, err := call(c, nil, "Echo", value)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != value {
+			t.Errorf("Echo(%q) = %q", value, got)
+		}
+	}
+}
+
+func TestPipeListenerAddrs(t *testing.T) {
+	l := rpc.NewPipeListener()
+	defer l.Close()
+	accepted := make(chan string, 2)
+	go func() {
+		for i := 0; i < 2; i++ {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			accepted <- conn.RemoteAddr().String()
+			conn.Close()
+		}
+	}()
+
+	seen := map[string]bool{}
+	for i := 0; i < 2; i++ {
+		conn, err := l.Dial("")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if conn.RemoteAddr() != l.Addr() {
+			t.Errorf("RemoteAddr() = %v, want %v", conn.RemoteAddr(), l.Addr())
+		}
+		if network := conn.LocalAddr().Network(); network != "pipe" {
+			t.Errorf("LocalAddr().Network() = %q, want \"pipe\"", network)
+		}
+		if remote := <-accepted; remote != conn.LocalAddr().String() {
+			t.Errorf("Server sees %q, client is %q", remote, conn.LocalAddr())
+		}
+		seen[conn.LocalAddr().String()] = true
+		conn.Close()
+	}
+	if len(seen) != 2 {
+		t.Errorf("Dialed connections share a local address: %v", seen)
+	}
+}
+
+func TestPipeListenerClose(t *testing.T) {
+	l := rpc.NewPipeListener()
+	l.Close()
+	if err := l.Close(); err != nil {
+		t.Errorf("Second Close() = %v", err)
+	}
+	if _, err := l.Accept(); err == nil {
+		t.Error("Accept() succeeded after Close()")
+	}
+	if _, err := l.Dial(""); err == nil {
+		t.Error("Dial() succeeded after Close()")
+	}
+}
+
+func TestPipeListenerDialWithoutAccept(t *testing.T) {
+	l := rpc.NewPipeListener()
+	defer l.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, err := l.DialContext(ctx, ""); err == nil {
+		t.Error("DialContext() succeeded without an Accept loop")
+	}
+
+	ctx, cancel = context.WithCancel(context.Background())
+	cancel()
+	if _, err := l.DialContext(ctx, ""); err != context.Canceled {
+		t.Errorf("DialContext() with a cancelled context = %v, want %v", err, context.Canceled)
+	}
+}
@@ -0,0 +1,112 @@
+package rpc
+
+import (
+	"time"
+)
+
+// ClientStats describes the connection pool of a Client.
+type ClientStats struct {
+	// PoolSize counts established connections and those being dialed.
+	PoolSize int
+	// IdleConns counts connections free for a call.
+	IdleConns int
+	// Grown and Shrunk count connections added on demand and closed after idling.
+	Grown  int64
+	Shrunk int64
+	// Waits counts calls that found no free connection, TotalWait and MaxWait are how long
+	// they waited for one.
+	Waits     int64
+	TotalWait time.Duration
+	MaxWait   time.Duration
+}
+
+func (c *Client) Stats() ClientStats {
+	c.mtxPool.Lock()
+	defer c.mtxPool.Unlock()
+
+	stats := c.stats
+	stats.PoolSize = c.poolSize
+	stats.IdleConns = len(c.freeConns)
+	return stats
+}
+
+// acquire takes a free connection from the pool, growing the pool if none is free. Fail-fast
+// calls give up once the Client is in TransientFailure, but wait while it is Connecting.
+func (c *Client) acquire(ctx *ClientContext) (*connEntry, error) {
+	select {
+	case <-c.closed:
+		return nil, makeClientErr("Client is closed")
+	case entry := <-c.freeConns:
+		return entry, nil
+	default:
+	}
+	if ctx.FailFast && c.State() == TransientFailure {
+		return nil, ErrUnavailable
+	}
+
+	c.grow()
+	waitStart := time.Now()
+	defer func() {
+		wait := time.Now().Sub(waitStart)
+		c.mtxPool.Lock()
+		c.stats.Waits++
+		c.stats.TotalWait += wait
+		if wait > c.stats.MaxWait {
+			c.stats.MaxWait = wait
+		}
+		c.mtxPool.Unlock()
+	}()
+
+	for {
+		state, stateChanged := c.stateAndChan()
+		if ctx.FailFast && state == TransientFailure {
+			return nil, ErrUnavailable
+		}
+		select {
+		case <-c.closed:
+			return nil, makeClientErr("Client is closed")
+		case <-ctx.Done():
+			return nil, makeClientErr(ctx.Err().Error())
+		case entry := <-c.freeConns:
+			return entry, nil
+		case <-stateChanged:
+		}
+	}
+}
+
+// grow asks connectLoop for one more connection, unless the pool is at its maximum.
+func (c *Client) grow() {
+	c.mtxPool.Lock()
+	defer c.mtxPool.Unlock()
+
+	if c.poolSize >= c.maxPoolSize {
+		return
+	}
+	c.poolSize++
+	c.stats.Grown++
+	c.shouldConnect <- struct{}{}
+	c.leaveIdle()
+}
+
+// retire closes the connection of entry without replacement, unless the pool is at its
+// minimum. It returns whether entry was retired.
+func (c *Client) retire(entry *connEntry) bool {
+	c.mtxPool.Lock()
+	if c.poolSize <= c.minPoolSize {
+		c.mtxPool.Unlock()
+		return false
+	}
+	c.poolSize--
+	c.stats.Shrunk++
+	empty := c.poolSize == 0
+	c.mtxPool.Unlock()
+
+	entry.conn.Close()
+	c.mtxEntries.Lock()
+	delete(c.entries, entry.localPort)
+	c.mtxEntries.Unlock()
+	if empty {
+		c.setStateIfNoConn(Idle)
+	}
+	return true
+}
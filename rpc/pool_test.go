@@ -0,0 +1,109 @@
+package rpc_test
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/xinlaini/golibs/rpc"
+)
+
+// startBlockingServer serves a Block method that returns once n calls are in flight. Each call
+// signals entered as it arrives.
+func startBlockingServer(t *testing.T, n int) (*countingListener, rpc.ClientOptions, chan struct{}) {
+	var inFlight sync.WaitGroup
+	inFlight.Add(n)
+	entered := make(chan struct{})
+	l, opts := startCountingServer(t, rpc.Config{
+		Services: map[string]rpc.ServiceConfig{
+			"Block": {Raw: func(ctx *rpc.ServerContext, requestPB []byte) ([]byte, error) {
+				entered <- struct{}{}
+				inFlight.Done()
+				inFlight.Wait()
+				return requestPB, nil
+			}},
+		},
+	}, "Block")
+	return l, opts, entered
+}
+
+// callConcurrently makes n concurrent calls to Block. Each call starts once the previous one
+// holds its connection, so that it finds none free and grows the pool.
+func callConcurrently(t *testing.T, c *rpc.Client, n int, entered <-chan struct{}) {
+	var calls sync.WaitGroup
+	for i := 0; i < n; i++ {
+		calls.Add(1)
+		go func() {
+			defer calls.Done()
+			if _, err := call(c, nil, "Block", "a"); err != nil {
+				t.Error(err)
+			}
+		}()
+		<-entered
+	}
+	calls.Wait()
+}
+
+func TestPoolGrowsOnDemand(t *testing.T) {
+	l, opts, entered := startBlockingServer(t, 4)
+	defer l.Close()
+	opts.ConnPoolSize = 0
+	opts.MaxConnPoolSize = 4
+	c := newClient(t, opts)
+	defer c.Close()
+
+	if size := c.Stats().PoolSize; size != 0 {
+		t.Errorf("PoolSize = %d before any call, want 0", size)
+	}
+	callConcurrently(t, c, 4, entered)
+	stats := c.Stats()
+	if stats.PoolSize != 4 || stats.Grown != 4 || stats.IdleConns != 4 {
+		t.Errorf("Stats() = %+v, want PoolSize, Grown and IdleConns 4", stats)
+	}
+	if stats.Waits == 0 || stats.MaxWait <= 0 || stats.TotalWait < stats.MaxWait {
+		t.Errorf("Stats() = %+v, want the waits for new connections counted", stats)
+	}
+	if n := l.numAccepted(); n != 4 {
+		t.Errorf("Server accepted %d connections, want 4", n)
+	}
+}
+
+func TestPoolShrinksAfterIdling(t *testing.T) {
+	l, opts, entered := startBlockingServer(t, 3)
+	defer l.Close()
+	opts.MaxConnPoolSize = 3
+	opts.PoolShrinkIdleTime = 40 * time.Millisecond
+	c := newClient(t, opts)
+	defer c.Close()
+
+	callConcurrently(t, c, 3, entered)
+	if size := c.Stats().PoolSize; size != 3 {
+		t.Fatalf("PoolSize = %d, want 3", size)
+	}
+	// The pool never shrinks below ConnPoolSize.
+	waitFor(t, "the pool to shrink", func() bool {
+		stats := c.Stats()
+		return stats.PoolSize == 1 && stats.Shrunk == 2
+	})
+}
+
+func TestPoolSizeValidation(t *testing.T) {
+	ctrl, err := rpc.NewController(rpc.Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, opts := range []rpc.ClientOptions{
+		{ConnPoolSize: -1, MaxConnPoolSize: 1},
+		{ConnPoolSize: 0, MaxConnPoolSize: 0},
+		{ConnPoolSize: 2, MaxConnPoolSize: 1},
+		{ConnPoolSize: 1, PoolShrinkIdleTime: -time.Second},
+	} {
+		opts.ServiceName = "Echo"
+		opts.ServiceAddr = "pipe:0"
+		opts.Retry = rpc.DefaultDialRetry
+		if c, err := ctrl.NewClient(opts); err == nil {
+			c.Close()
+			t.Errorf("NewClient(%+v) succeeded", opts)
+		}
+	}
+}
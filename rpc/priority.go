@@ -0,0 +1,165 @@
+package rpc
+
+import (
+	"container/heap"
+	"errors"
+	"sync"
+	"time"
+)
+
+// Priority orders requests competing for the server's dispatcher, higher first.
+type Priority int32
+
+const (
+	// PriorityLow suits batch and background traffic, which is shed first under overload.
+	PriorityLow Priority = -1
+	// PriorityNormal is the default.
+	PriorityNormal Priority = 0
+	// PriorityHigh suits interactive traffic.
+	PriorityHigh Priority = 1
+)
+
+var (
+	errShed          = errors.New("Server is overloaded, request is shed")
+	errQueueTimedOut = errors.New("Timed out waiting in the server queue")
+)
+
+type waiter struct {
+	priority Priority
+	seq      uint64
+	// admitted receives nil once the request may run, or errShed if it's dropped.
+	admitted chan error
+	index    int
+}
+
+// waitQueue is a heap of waiters, highest priority first, then first come first served.
+type waitQueue []*waiter
+
+func (q waitQueue) Len() int {
+	return len(q)
+}
+
+func (q waitQueue) Less(i, j int) bool {
+	if q[i].priority != q[j].priority {
+		return q[i].priority > q[j].priority
+	}
+	return q[i].seq < q[j].seq
+}
+
+func (q waitQueue) Swap(i, j int) {
+	q[i], q[j] = q[j], q[i]
+	q[i].index = i
+	q[j].index = j
+}
+
+func (q *waitQueue) Push(x interface{}) {
+	w := x.(*waiter)
+	w.index = len(*q)
+	*q = append(*q, w)
+}
+
+func (q *waitQueue) Pop() interface{} {
+	old := *q
+	w := old[len(old)-1]
+	*q = old[:len(old)-1]
+	w.index = -1
+	return w
+}
+
+// lowest returns the waiter to shed first: lowest priority, then latest arrival.
+func (q waitQueue) lowest() *waiter {
+	var lowest *waiter
+	for _, w := range q {
+		if lowest == nil || w.priority < lowest.priority ||
+			(w.priority == lowest.priority && w.seq > lowest.seq) {
+			lowest = w
+		}
+	}
+	return lowest
+}
+
+// dispatcher runs at most maxRunning requests at a time. Others wait in a queue of at most
+// maxQueued, from which the lowest priority ones are shed when it overflows.
+type dispatcher struct {
+	maxRunning int
+	maxQueued  int
+	running    int
+	queue      waitQueue
+	seq        uint64
+	mtx        sync.Mutex
+}
+
+// admit waits for the request to be allowed to run, for up to timeout if >0. On success,
+// release must be called once the request is done.
+func (d *dispatcher) admit(priority Priority, timeout time.Duration) error {
+	d.mtx.Lock()
+	if d.running < d.maxRunning && len(d.queue) == 0 {
+		d.running++
+		d.mtx.Unlock()
+		return nil
+	}
+	if len(d.queue) >= d.maxQueued {
+		lowest := d.queue.lowest()
+		if lowest == nil || lowest.priority >= priority {
+			d.mtx.Unlock()
+			return errShed
+		}
+		heap.Remove(&d.queue, lowest.index)
+		lowest.admitted <- errShed
+	}
+	d.seq++
+	w := &waiter{
+		priority: priority,
+		seq:      d.seq,
+		admitted: make(chan error, 1),
+	}
+	heap.Push(&d.queue, w)
+	d.mtx.Unlock()
+
+	var expired <-chan time.Time
+	if timeout > 0 {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		expired = timer.C
+	}
+	select {
+	case err := <-w.admitted:
+		return err
+	case <-expired:
+	}
+
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+	if w.index < 0 {
+		// Admitted or shed meanwhile.
+		if err := <-w.admitted; err != nil {
+			return err
+		}
+		d.releaseLocked()
+		return errQueueTimedOut
+	}
+	heap.Remove(&d.queue, w.index)
+	return errQueueTimedOut
+}
+
+func (d *dispatcher) release() {
+	d.mtx.Lock()
+	d.releaseLocked()
+	d.mtx.Unlock()
+}
+
+// releaseLocked frees a running slot and hands it to the next waiter. mtx must be held.
+func (d *dispatcher) releaseLocked() {
+	d.running--
+	if len(d.queue) > 0 && d.running < d.maxRunning {
+		d.running++
+		heap.Pop(&d.queue).(*waiter).admitted <- nil
+	}
+}
+
+func newDispatcher(maxRunning, maxQueued int) *dispatcher {
+	return &dispatcher{
+		maxRunning: maxRunning,
+		maxQueued:  maxQueued,
+	}
+}
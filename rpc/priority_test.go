@@ -0,0 +1,79 @@
+package rpc
+
+import (
+	"testing"
+	"time"
+)
+
+// admitAsync admits a request in the background, and returns the channel receiving the
+// outcome.
+func admitAsync(d *dispatcher, priority Priority, timeout time.Duration) <-chan error {
+	admitted := make(chan error, 1)
+	go func() {
+		admitted <- d.admit(priority, timeout)
+	}()
+	return admitted
+}
+
+// waitQueued waits until n requests are queued in d.
+func waitQueued(t *testing.T, d *dispatcher, n int) {
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(time.Millisecond) {
+		d.mtx.Lock()
+		queued := len(d.queue)
+		d.mtx.Unlock()
+		if queued == n {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%d requests are queued, want %d", queued, n)
+		}
+	}
+}
+
+func TestDispatcherPriorities(t *testing.T) {
+	d := newDispatcher(1, 3)
+	if err := d.admit(PriorityNormal, 0); err != nil {
+		t.Fatal(err)
+	}
+	low := admitAsync(d, PriorityLow, 0)
+	waitQueued(t, d, 1)
+	normal := admitAsync(d, PriorityNormal, 0)
+	waitQueued(t, d, 2)
+	high := admitAsync(d, PriorityHigh, 0)
+	waitQueued(t, d, 3)
+
+	// The queue is full: an equal priority is shed, a higher one sheds the lowest queued.
+	if err := d.admit(PriorityLow, 0); err != errShed {
+		t.Errorf("Low priority request on a full queue got %v, want errShed", err)
+	}
+	highest := admitAsync(d, PriorityHigh+1, 0)
+	if err := <-low; err != errShed {
+		t.Errorf("Queued low priority request got %v, want errShed", err)
+	}
+
+	for _, admitted := range []<-chan error{highest, high, normal} {
+		d.release()
+		if err := <-admitted; err != nil {
+			t.Fatal(err)
+		}
+	}
+	d.release()
+	if d.running != 0 || len(d.queue) != 0 {
+		t.Errorf("Dispatcher has %d running and %d queued requests, want none", d.running, len(d.queue))
+	}
+}
+
+func TestDispatcherTimeout(t *testing.T) {
+	d := newDispatcher(1, 1)
+	if err := d.admit(PriorityNormal, 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.admit(PriorityNormal, 10*time.Millisecond); err != errQueueTimedOut {
+		t.Errorf("Queued request got %v, want errQueueTimedOut", err)
+	}
+	waitQueued(t, d, 0)
+	d.release()
+	if err := d.admit(PriorityNormal, 10*time.Millisecond); err != nil {
+		t.Errorf("Request on an idle dispatcher got %v", err)
+	}
+}
@@ -0,0 +1,7 @@
+//go:build race
+
+package rpc_test
+
+func init() {
+	raceEnabled = true
+}
@@ -0,0 +1,112 @@
+package rpctest
+
+import (
+	"reflect"
+	"testing"
+
+	"gen/pb/rpc/rpc_proto"
+
+	"github.com/golang/protobuf/proto"
+)
+
+// CallsTo returns the calls to methodName, in arrival order.
+func CallsTo(calls []*Call, methodName string) []*Call {
+	var matched []*Call
+	for _, call := range calls {
+		if call.MethodName() == methodName {
+			matched = append(matched, call)
+		}
+	}
+	return matched
+}
+
+// AssertCallCount fails t unless methodName was called exactly want times.
+func AssertCallCount(t testing.TB, calls []*Call, methodName string, want int) {
+	t.Helper()
+	if got := len(CallsTo(calls, methodName)); got != want {
+		t.Errorf("Method '%s' was called %d times, want %d", methodName, got, want)
+	}
+}
+
+// AssertCalled fails t unless methodName was called, and returns the last such call.
+func AssertCalled(t testing.TB, calls []*Call, methodName string) *Call {
+	t.Helper()
+	matched := CallsTo(calls, methodName)
+	if len(matched) == 0 {
+		t.Fatalf("Method '%s' was never called", methodName)
+	}
+	return matched[len(matched)-1]
+}
+
+// AssertNotCalled fails t if methodName was called.
+func AssertNotCalled(t testing.TB, calls []*Call, methodName string) {
+	t.Helper()
+	AssertCallCount(t, calls, methodName, 0)
+}
+
+// AssertRequest fails t unless the request of call equals want. A nil want expects a nil
+// request.
+func AssertRequest(t testing.TB, call *Call, want proto.Message) {
+	t.Helper()
+	if want == nil || reflect.ValueOf(want).IsNil() {
+		if call.RequestPb != nil {
+			t.Errorf("Method '%s' got a non-nil request, want nil", call.MethodName())
+		}
+		return
+	}
+	if call.RequestPb == nil {
+		t.Errorf("Method '%s' got a nil request, want:\n%s", call.MethodName(), proto.MarshalTextString(want))
+		return
+	}
+	got := reflect.New(reflect.TypeOf(want).Elem()).Interface().(proto.Message)
+	if err := call.Unmarshal(got); err != nil {
+		t.Errorf("Failed to unmarshal request of method '%s': %s", call.MethodName(), err)
+		return
+	}
+	if !proto.Equal(got, want) {
+		t.Errorf(
+			"Method '%s' got request:\n%s\nwant:\n%s",
+			call.MethodName(), proto.MarshalTextString(got), proto.MarshalTextString(want))
+	}
+}
+
+// AssertMetadata fails t unless every field set in want has the same value in the metadata
+// of call. Unset fields in want are not compared.
+func AssertMetadata(t testing.TB, call *Call, want *rpc_proto.RequestMetadata) {
+	t.Helper()
+	gotValue := reflect.ValueOf(call.Metadata).Elem()
+	wantValue := reflect.ValueOf(want).Elem()
+	for i := 0; i < wantValue.NumField(); i++ {
+		field := wantValue.Type().Field(i)
+		if field.PkgPath != "" || isZero(wantValue.Field(i)) {
+			continue
+		}
+		if !reflect.DeepEqual(gotValue.Field(i).Interface(), wantValue.Field(i).Interface()) {
+			t.Errorf(
+				"Method '%s' got metadata %s=%v, want %v",
+				call.MethodName(),
+				field.Name,
+				reflect.Indirect(gotValue.Field(i)),
+				reflect.Indirect(wantValue.Field(i)))
+		}
+	}
+}
+
+// AssertHeader fails t unless call carried the custom metadata key with value want.
+func AssertHeader(t testing.TB, call *Call, key, want string) {
+	t.Helper()
+	got, found := call.Header[key]
+	if !found {
+		t.Errorf("Method '%s' got no header '%s', want %q", call.MethodName(), key, want)
+	} else if got != want {
+		t.Errorf("Method '%s' got header '%s'=%q, want %q", call.MethodName(), key, got, want)
+	}
+}
+
+func isZero(v reflect.Value) bool {
+	switch v.Kind() {
+	case reflect.Ptr, reflect.Slice, reflect.Map, reflect.Interface:
+		return v.IsNil()
+	}
+	return reflect.DeepEqual(v.Interface(), reflect.Zero(v.Type()).Interface())
+}
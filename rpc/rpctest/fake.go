@@ -0,0 +1,145 @@
+package rpctest
+
+import (
+	"fmt"
+	"reflect"
+	"sync"
+
+	"gen/pb/rpc/rpc_proto"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/xinlaini/golibs/rpc"
+)
+
+// Call is a request received by a FakeServer.
+type Call struct {
+	Metadata  *rpc_proto.RequestMetadata
+	RequestPb []byte
+	// Header is the custom metadata sent with the call.
+	Header rpc.MD
+}
+
+// MethodName returns the name of the called method.
+func (call *Call) MethodName() string {
+	return call.Metadata.GetMethodName()
+}
+
+// Unmarshal decodes the request payload into pb, honoring the text proto flag.
+func (call *Call) Unmarshal(pb proto.Message) error {
+	if call.isTextPB() {
+		return proto.UnmarshalText(string(call.RequestPb), pb)
+	}
+	return proto.Unmarshal(call.RequestPb, pb)
+}
+
+func (call *Call) isTextPB() bool {
+	return call.Metadata.GetFlags()&uint32(rpc_proto.Flag_TEXT_PB_PAYLOAD) != 0
+}
+
+// HandlerFunc computes the response of a call to a FakeServer.
+type HandlerFunc func(ctx *rpc.ServerContext, call *Call) (proto.Message, error)
+
+// FakeServer serves one service whose methods return canned responses or run handler funcs,
+// and records every call it receives. Methods without a response or handler fail.
+type FakeServer struct {
+	*Server
+	serviceName string
+
+	handlers map[string]HandlerFunc
+	calls    []*Call
+	mtx      sync.Mutex
+}
+
+// SetResponse makes methodName return resp.
+func (fs *FakeServer) SetResponse(methodName string, resp proto.Message) {
+	fs.SetHandler(methodName, func(*rpc.ServerContext, *Call) (proto.Message, error) {
+		return resp, nil
+	})
+}
+
+// SetError makes methodName fail with err.
+func (fs *FakeServer) SetError(methodName string, err error) {
+	fs.SetHandler(methodName, func(*rpc.ServerContext, *Call) (proto.Message, error) {
+		return nil, err
+	})
+}
+
+// SetHandler makes methodName run handler.
+func (fs *FakeServer) SetHandler(methodName string, handler HandlerFunc) {
+	fs.mtx.Lock()
+	fs.handlers[methodName] = handler
+	fs.mtx.Unlock()
+}
+
+// Calls returns every call received so far, in arrival order.
+func (fs *FakeServer) Calls() []*Call {
+	fs.mtx.Lock()
+	defer fs.mtx.Unlock()
+	return append([]*Call(nil), fs.calls...)
+}
+
+// Reset forgets all received calls.
+func (fs *FakeServer) Reset() {
+	fs.mtx.Lock()
+	fs.calls = nil
+	fs.mtx.Unlock()
+}
+
+// NewClient creates a client of the faked service.
+func (fs *FakeServer) NewClient() (*rpc.Client, error) {
+	return fs.Server.NewClient(fs.serviceName)
+}
+
+func (fs *FakeServer) serve(ctx *rpc.ServerContext, requestPB []byte) ([]byte, error) {
+	call := &Call{
+		Metadata:  proto.Clone(ctx.Metadata).(*rpc_proto.RequestMetadata),
+		RequestPb: requestPB,
+		Header:    ctx.RequestHeader,
+	}
+	fs.mtx.Lock()
+	fs.calls = append(fs.calls, call)
+	handler, found := fs.handlers[call.MethodName()]
+	fs.mtx.Unlock()
+
+	if !found {
+		return nil, fmt.Errorf("Method '%s.%s' is not faked", fs.serviceName, call.MethodName())
+	}
+	resp, err := handler(ctx, call)
+	if err != nil {
+		return nil, err
+	}
+	if resp == nil || reflect.ValueOf(resp).IsNil() {
+		return nil, nil
+	}
+	if call.isTextPB() {
+		return []byte(proto.MarshalTextString(resp)), nil
+	}
+	return proto.Marshal(resp)
+}
+
+// StartFakeServer starts a fake of serviceName on an ephemeral loopback TCP port.
+func StartFakeServer(serviceName string) (*FakeServer, error) {
+	return startFakeServer(serviceName, StartServer)
+}
+
+// StartPipeFakeServer starts a fake of serviceName on an in-memory rpc.PipeListener.
+func StartPipeFakeServer(serviceName string) (*FakeServer, error) {
+	return startFakeServer(serviceName, StartPipeServer)
+}
+
+func startFakeServer(serviceName string, start func(rpc.Config) (*Server, error)) (*FakeServer, error) {
+	fs := &FakeServer{
+		serviceName: serviceName,
+		handlers:    make(map[string]HandlerFunc),
+	}
+	var err error
+	fs.Server, err = start(rpc.Config{
+		Services: map[string]rpc.ServiceConfig{
+			serviceName: {Raw: fs.serve},
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+	return fs, nil
+}
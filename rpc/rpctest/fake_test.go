@@ -0,0 +1,118 @@
+package rpctest_test
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"gen/pb/rpc/rpc_proto"
+
+	"github.com/golang/protobuf/proto"
+	"golang.org/x/net/context"
+
+	"github.com/xinlaini/golibs/rpc"
+	"github.com/xinlaini/golibs/rpc/rpctest"
+)
+
+var (
+	kvType = reflect.TypeOf(rpc_proto.KeyValue{})
+)
+
+func kv(value string) *rpc_proto.KeyValue {
+	return &rpc_proto.KeyValue{Value: proto.String(value)}
+}
+
+func call(c *rpc.Client, methodName string, request proto.Message, header rpc.MD) (proto.Message, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	return c.Call(methodName, &rpc.ClientContext{Context: ctx, RequestHeader: header}, request, kvType)
+}
+
+func TestFakeServer(t *testing.T) {
+	for name, start := range map[string]func(string) (*rpctest.FakeServer, error){
+		"TCP":  rpctest.StartFakeServer,
+		"Pipe": rpctest.StartPipeFakeServer,
+	} {
+		t.Run(name, func(t *testing.T) {
+			fs, err := start("Store")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer fs.Close()
+			c, err := fs.NewClient()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer c.Close()
+
+			fs.SetResponse("Get", kv("canned"))
+			fs.SetError("Put", errors.New("read only"))
+			fs.SetHandler("Upper", func(ctx *rpc.ServerContext, call *rpctest.Call) (proto.Message, error) {
+				request := &rpc_proto.KeyValue{}
+				if err := call.Unmarshal(request); err != nil {
+					return nil, err
+				}
+				return kv(strings.ToUpper(request.GetValue())), nil
+			})
+
+			response, err := call(c, "Get", kv("key"), rpc.MD{"tenant": "t1"})
+			if err != nil || response.(*rpc_proto.KeyValue).GetValue() != "canned" {
+				t.Errorf("Get = %v, %v, want canned", response, err)
+			}
+			if _, err := call(c, "Put", kv("key"), nil); err == nil || !strings.Contains(err.Error(), "read only") {
+				t.Errorf("Put error = %v, want read only", err)
+			}
+			response, err = call(c, "Upper", kv("abc"), nil)
+			if err != nil || response.(*rpc_proto.KeyValue).GetValue() != "ABC" {
+				t.Errorf("Upper = %v, %v, want ABC", response, err)
+			}
+			if _, err := call(c, "Delete", nil, nil); err == nil || !strings.Contains(err.Error(), "not faked") {
+				t.Errorf("Delete error = %v, want not faked", err)
+			}
+
+			calls := fs.Calls()
+			if len(calls) != 4 {
+				t.Fatalf("Got %d calls, want 4", len(calls))
+			}
+			get := rpctest.AssertCalled(t, calls, "Get")
+			rpctest.AssertRequest(t, get, kv("key"))
+			rpctest.AssertMetadata(t, get, &rpc_proto.RequestMetadata{
+				ServiceName: proto.String("Store"),
+				MethodName:  proto.String("Get"),
+			})
+			rpctest.AssertHeader(t, get, "tenant", "t1")
+			rpctest.AssertCallCount(t, calls, "Put", 1)
+			rpctest.AssertRequest(t, rpctest.AssertCalled(t, calls, "Delete"), nil)
+			rpctest.AssertNotCalled(t, calls, "List")
+			if methods := []string{
+				calls[0].MethodName(), calls[1].MethodName(), calls[2].MethodName(), calls[3].MethodName(),
+			}; !reflect.DeepEqual(methods, []string{"Get", "Put", "Upper", "Delete"}) {
+				t.Errorf("Calls() are in order %v", methods)
+			}
+
+			fs.Reset()
+			if calls := fs.Calls(); len(calls) != 0 {
+				t.Errorf("Got %d calls after Reset(), want 0", len(calls))
+			}
+		})
+	}
+}
+
+func TestCallsTo(t *testing.T) {
+	calls := []*rpctest.Call{
+		{Metadata: &rpc_proto.RequestMetadata{MethodName: proto.String("A")}},
+		{Metadata: &rpc_proto.RequestMetadata{MethodName: proto.String("B")}},
+		{Metadata: &rpc_proto.RequestMetadata{MethodName: proto.String("A")}},
+	}
+	if matched := rpctest.CallsTo(calls, "A"); len(matched) != 2 || matched[0] != calls[0] || matched[1] != calls[2] {
+		t.Errorf("CallsTo(A) = %v", matched)
+	}
+	if matched := rpctest.CallsTo(calls, "C"); len(matched) != 0 {
+		t.Errorf("CallsTo(C) = %v", matched)
+	}
+	if last := rpctest.AssertCalled(t, calls, "A"); last != calls[2] {
+		t.Error("AssertCalled(A) did not return the last call")
+	}
+}
@@ -0,0 +1,112 @@
+package rpctest
+
+import (
+	"fmt"
+	"reflect"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/xinlaini/golibs/rpc"
+)
+
+var (
+	serverCtxPtrType = reflect.TypeOf((*rpc.ServerContext)(nil))
+	pbMessageType    = reflect.TypeOf((*proto.Message)(nil)).Elem()
+	errorType        = reflect.TypeOf((*error)(nil)).Elem()
+)
+
+// MockServer is a FakeServer driven by the interface of a service, e.g. a generated
+// FooServiceType. Its handlers have the signatures of the interface's methods, and requests are
+// decoded into the methods' request types.
+type MockServer struct {
+	*FakeServer
+	serviceType reflect.Type
+}
+
+// On makes methodName run handler, a func with the signature of the interface's method, e.g.
+// func(*rpc.ServerContext, *pb.GetRequest) (*pb.GetResponse, error). It panics if the interface
+// has no such method or the signatures differ.
+func (ms *MockServer) On(methodName string, handler interface{}) {
+	m, found := ms.serviceType.MethodByName(methodName)
+	if !found {
+		panic(fmt.Sprintf("'%s' has no method '%s'", ms.serviceType, methodName))
+	}
+	handlerValue := reflect.ValueOf(handler)
+	if handlerValue.Type() != m.Type {
+		panic(fmt.Sprintf("Handler of '%s.%s' is '%s', must be '%s'",
+			ms.serviceType, methodName, handlerValue.Type(), m.Type))
+	}
+	requestType := m.Type.In(1).Elem()
+	ms.SetHandler(methodName, func(ctx *rpc.ServerContext, call *Call) (proto.Message, error) {
+		request := reflect.New(requestType)
+		if err := call.Unmarshal(request.Interface().(proto.Message)); err != nil {
+			return nil, err
+		}
+		results := handlerValue.Call([]reflect.Value{reflect.ValueOf(ctx), request})
+		if err, _ := results[1].Interface().(error); err != nil {
+			return nil, err
+		}
+		return results[0].Interface().(proto.Message), nil
+	})
+}
+
+// Requests returns the decoded requests of the calls to methodName, in arrival order.
+func (ms *MockServer) Requests(methodName string) ([]proto.Message, error) {
+	m, found := ms.serviceType.MethodByName(methodName)
+	if !found {
+		return nil, fmt.Errorf("'%s' has no method '%s'", ms.serviceType, methodName)
+	}
+	var requests []proto.Message
+	for _, call := range CallsTo(ms.Calls(), methodName) {
+		request := reflect.New(m.Type.In(1).Elem()).Interface().(proto.Message)
+		if err := call.Unmarshal(request); err != nil {
+			return nil, err
+		}
+		requests = append(requests, request)
+	}
+	return requests, nil
+}
+
+// StartMockServer starts a mock of serviceName, whose interface is serviceType, on an ephemeral
+// loopback TCP port.
+func StartMockServer(serviceName string, serviceType reflect.Type) (*MockServer, error) {
+	return startMockServer(serviceName, serviceType, StartServer)
+}
+
+// StartPipeMockServer starts a mock of serviceName, whose interface is serviceType, on an
+// in-memory rpc.PipeListener.
+func StartPipeMockServer(serviceName string, serviceType reflect.Type) (*MockServer, error) {
+	return startMockServer(serviceName, serviceType, StartPipeServer)
+}
+
+func startMockServer(
+	serviceName string, serviceType reflect.Type, start func(rpc.Config) (*Server, error)) (*MockServer, error) {
+	if err := checkServiceType(serviceType); err != nil {
+		return nil, err
+	}
+	fs, err := startFakeServer(serviceName, start)
+	if err != nil {
+		return nil, err
+	}
+	return &MockServer{FakeServer: fs, serviceType: serviceType}, nil
+}
+
+// checkServiceType fails unless every method of serviceType can be served.
+func checkServiceType(serviceType reflect.Type) error {
+	if serviceType.Kind() != reflect.Interface {
+		return fmt.Errorf("'%s' is not an Interface kind", serviceType)
+	}
+	for i := 0; i < serviceType.NumMethod(); i++ {
+		m := serviceType.Method(i)
+		mType := m.Type
+		if mType.NumIn() != 2 || mType.In(0) != serverCtxPtrType || !isPBPtr(mType.In(1)) ||
+			mType.NumOut() != 2 || !isPBPtr(mType.Out(0)) || mType.Out(1) != errorType {
+			return fmt.Errorf("Method '%s.%s' has signature '%s', must be "+
+				"func(*rpc.ServerContext, *RequestPB) (*ResponsePB, error)", serviceType, m.Name, mType)
+		}
+	}
+	return nil
+}
+
+func isPBPtr(typ reflect.Type) bool {
+	return typ.Kind() == reflect.Ptr && typ.Implements(pbMessageType)
+}
@@ -0,0 +1,93 @@
+package rpctest_test
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+
+	"gen/pb/rpc/rpc_proto"
+
+	"github.com/golang/protobuf/proto"
+
+	"github.com/xinlaini/golibs/rpc"
+	"github.com/xinlaini/golibs/rpc/rpctest"
+)
+
+// storeService is what protoc-gen-golibsrpc generates for a Store service.
+type storeService interface {
+	Get(ctx *rpc.ServerContext, req *rpc_proto.KeyValue) (*rpc_proto.KeyValue, error)
+	Put(ctx *rpc.ServerContext, req *rpc_proto.KeyValue) (*rpc_proto.KeyValue, error)
+}
+
+var storeServiceType = reflect.TypeOf((*storeService)(nil)).Elem()
+
+func TestMockServer(t *testing.T) {
+	ms, err := rpctest.StartPipeMockServer("Store", storeServiceType)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ms.Close()
+	c, err := ms.NewClient()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	ms.On("Get", func(ctx *rpc.ServerContext, req *rpc_proto.KeyValue) (*rpc_proto.KeyValue, error) {
+		return kv(strings.ToUpper(req.GetValue())), nil
+	})
+	ms.On("Put", func(ctx *rpc.ServerContext, req *rpc_proto.KeyValue) (*rpc_proto.KeyValue, error) {
+		return nil, errors.New("read only")
+	})
+
+	response, err := call(c, "Get", kv("abc"), nil)
+	if err != nil || response.(*rpc_proto.KeyValue).GetValue() != "ABC" {
+		t.Errorf("Get = %v, %v, want ABC", response, err)
+	}
+	if _, err := call(c, "Put", kv("key"), nil); err == nil || !strings.Contains(err.Error(), "read only") {
+		t.Errorf("Put error = %v, want read only", err)
+	}
+	requests, err := ms.Requests("Get")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(requests) != 1 || !proto.Equal(requests[0], kv("abc")) {
+		t.Errorf("Get requests = %v, want [%v]", requests, kv("abc"))
+	}
+	if _, err := ms.Requests("List"); err == nil {
+		t.Error("Requests(List) succeeded for a method not in the interface")
+	}
+}
+
+func TestMockServerChecksHandlers(t *testing.T) {
+	ms, err := rpctest.StartPipeMockServer("Store", storeServiceType)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ms.Close()
+	for name, test := range map[string]struct {
+		methodName string
+		handler    interface{}
+	}{
+		"unknown method": {"List", func(*rpc.ServerContext, *rpc_proto.KeyValue) (*rpc_proto.KeyValue, error) {
+			return nil, nil
+		}},
+		"wrong signature": {"Get", func(*rpc.ServerContext, *rpc_proto.Request) (*rpc_proto.KeyValue, error) {
+			return nil, nil
+		}},
+	} {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Errorf("On() accepted a handler with %s", name)
+				}
+			}()
+			ms.On(test.methodName, test.handler)
+		}()
+	}
+
+	if _, err := rpctest.StartPipeMockServer("Store", reflect.TypeOf(rpc_proto.KeyValue{})); err == nil {
+		t.Error("Started a mock of a struct type")
+	}
+}
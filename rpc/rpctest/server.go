@@ -0,0 +1,98 @@
+// Package rpctest provides utilities for testing code built on the rpc package: real
+// controllers serving on loopback or in-memory listeners, fake servers with canned responses,
+// mock servers driven by service interfaces, and assertions on the calls a Client made.
+package rpctest
+
+import (
+	"net"
+	"time"
+
+	"github.com/xinlaini/golibs/log"
+	"github.com/xinlaini/golibs/rpc"
+)
+
+var (
+	// TestDialRetry redials quickly, so that tests don't wait on DefaultDialRetry.
+	TestDialRetry = rpc.DialRetryPolicy{
+		Sleep:    10 * time.Millisecond,
+		Backoff:  2,
+		MaxSleep: time.Second,
+	}
+)
+
+// Server is a real rpc.Controller serving on a loopback TCP port or an in-memory listener.
+type Server struct {
+	Controller *rpc.Controller
+	Listener   net.Listener
+
+	dial      rpc.DialFunc
+	serveDone chan struct{}
+}
+
+// ClientOptions returns options for a client of serviceName connected to this server.
+func (s *Server) ClientOptions(serviceName string) rpc.ClientOptions {
+	return rpc.ClientOptions{
+		ServiceName:  serviceName,
+		ServiceAddr:  s.Listener.Addr().String(),
+		ConnPoolSize: 1,
+		Retry:        TestDialRetry,
+		Dial:         s.dial,
+	}
+}
+
+// NewClient creates a client of serviceName connected to this server.
+func (s *Server) NewClient(serviceName string) (*rpc.Client, error) {
+	return s.Controller.NewClient(s.ClientOptions(serviceName))
+}
+
+// Close stops accepting new connections.
+func (s *Server) Close() {
+	s.Listener.Close()
+	<-s.serveDone
+}
+
+// StartServer starts a controller with config on an ephemeral loopback TCP port.
+func StartServer(config rpc.Config) (*Server, error) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	s, err := startServer(config, l, nil)
+	if err != nil {
+		l.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+// StartPipeServer starts a controller with config on an in-memory rpc.PipeListener.
+func StartPipeServer(config rpc.Config) (*Server, error) {
+	l := rpc.NewPipeListener()
+	s, err := startServer(config, l, l.Dial)
+	if err != nil {
+		l.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+func startServer(config rpc.Config, l net.Listener, dial rpc.DialFunc) (*Server, error) {
+	if config.Logger == nil {
+		config.Logger = xlog.NewNilLogger()
+	}
+	ctrl, err := rpc.NewController(config)
+	if err != nil {
+		return nil, err
+	}
+	s := &Server{
+		Controller: ctrl,
+		Listener:   l,
+		dial:       dial,
+		serveDone:  make(chan struct{}),
+	}
+	go func() {
+		ctrl.ServeListener(l)
+		close(s.serveDone)
+	}()
+	return s, nil
+}
@@ -0,0 +1,236 @@
+package rpc
+
+import (
+	"fmt"
+	"html/template"
+	"net/http"
+	"reflect"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"gen/pb/rpc/rpc_proto"
+
+	"github.com/golang/protobuf/proto"
+	"golang.org/x/net/context"
+)
+
+const (
+	maxRequestSummaryLen = 512
+)
+
+var (
+	rpczTemplate = template.Must(template.New("rpcz").Parse(`<html>
+<head><title>rpcz</title></head>
+<body>
+<h2>{{len .Rows}} in-flight requests</h2>
+<table border="1" cellpadding="4">
+<tr><th>Method</th><th>Client</th><th>Elapsed</th><th>Remaining</th><th>Request</th>{{if .AllowCancel}}<th></th>{{end}}</tr>
+{{range .Rows}}<tr>
+<td>{{.Method}}</td>
+<td>{{.Client}}</td>
+<td>{{.Elapsed}}</td>
+<td>{{.Remaining}}</td>
+<td><pre>{{.Summary}}</pre></td>
+{{if $.AllowCancel}}<td><form method="POST"><input type="hidden" name="cancel" value="{{.ID}}"><input type="submit" value="Cancel"></form></td>
+{{end}}</tr>
+{{end}}</table>
+</body>
+</html>
+`))
+)
+
+// inflightRequest is a snapshot of a request taken when it starts, as its handler may modify
+// the request while it is listed.
+type inflightRequest struct {
+	id     uint64
+	method string
+	client string
+	// msgType is the type of the decoded request, nil for raw handlers. The request is only
+	// summarized when listed, by decoding payload anew.
+	msgType reflect.Type
+	// payload is the request payload of a decoded request, which its handler doesn't see. Raw
+	// handlers see theirs, so payload is then a copy, truncated to the summary length, of a
+	// text payload, and nil otherwise.
+	payload []byte
+	textPB  bool
+	// size is the size of the request payload, -1 if nil.
+	size    int
+	started time.Time
+	// deadline is zero if none.
+	deadline time.Time
+	cancel   context.CancelFunc
+}
+
+// inflightRequests tracks the requests being served, so that they can be listed and
+// cancelled on /rpcz.
+type inflightRequests struct {
+	// allowCancel lets POST requests to /rpcz cancel requests.
+	allowCancel bool
+	requests    map[uint64]*inflightRequest
+	nextID      uint64
+	mtx         sync.Mutex
+}
+
+func (req *inflightRequest) summary() string {
+	summary := fmt.Sprintf("<%d bytes>", req.size)
+	switch {
+	case req.size < 0:
+		summary = "<nil>"
+	case req.msgType != nil:
+		msg := reflect.New(req.msgType.Elem()).Interface().(proto.Message)
+		var err error
+		if req.textPB {
+			err = proto.UnmarshalText(string(req.payload), msg)
+		} else {
+			err = proto.Unmarshal(req.payload, msg)
+		}
+		if err == nil {
+			summary = proto.CompactTextString(msg)
+		}
+	case req.textPB:
+		summary = string(req.payload)
+	}
+	if len(summary) > maxRequestSummaryLen {
+		summary = summary[:maxRequestSummaryLen] + "..."
+	}
+	return summary
+}
+
+// add tracks request, decoded as msg unless nil, served with ctx until the returned func is
+// called.
+func (ir *inflightRequests) add(
+	ctx *ServerContext, cancel context.CancelFunc, request *rpc_proto.Request, msg proto.Message) func() {
+	ir.mtx.Lock()
+	defer ir.mtx.Unlock()
+	ir.nextID++
+	id := ir.nextID
+	reqMeta := request.Metadata
+	req := &inflightRequest{
+		id:      id,
+		method:  reqMeta.GetServiceName() + "." + reqMeta.GetMethodName(),
+		client:  reqMeta.GetClientJobName() + "@" + reqMeta.GetClientAddr(),
+		textPB:  reqMeta.GetFlags()&uint32(rpc_proto.Flag_TEXT_PB_PAYLOAD) != 0,
+		size:    len(request.RequestPb),
+		started: time.Now(),
+		cancel:  cancel,
+	}
+	switch {
+	case request.RequestPb == nil:
+		req.size = -1
+	case msg != nil:
+		req.msgType = reflect.TypeOf(msg)
+		req.payload = request.RequestPb
+	case req.textPB:
+		n := len(request.RequestPb)
+		if n > maxRequestSummaryLen+1 {
+			n = maxRequestSummaryLen + 1
+		}
+		req.payload = append([]byte(nil), request.RequestPb[:n]...)
+	}
+	req.deadline, _ = ctx.Deadline()
+	ir.requests[id] = req
+	return func() {
+		ir.mtx.Lock()
+		delete(ir.requests, id)
+		ir.mtx.Unlock()
+	}
+}
+
+func (ir *inflightRequests) cancel(id uint64) bool {
+	ir.mtx.Lock()
+	req, found := ir.requests[id]
+	ir.mtx.Unlock()
+	if found {
+		req.cancel()
+	}
+	return found
+}
+
+type rpczRow struct {
+	ID        uint64
+	Method    string
+	Client    string
+	Elapsed   time.Duration
+	Remaining string
+	Summary   string
+}
+
+// rows lists the requests oldest first.
+func (ir *inflightRequests) rows(now time.Time) []rpczRow {
+	ir.mtx.Lock()
+	requests := make([]*inflightRequest, 0, len(ir.requests))
+	for _, req := range ir.requests {
+		requests = append(requests, req)
+	}
+	ir.mtx.Unlock()
+	sort.Sort(byStarted(requests))
+
+	rows := make([]rpczRow, len(requests))
+	for i, req := range requests {
+		rows[i] = rpczRow{
+			ID:        req.id,
+			Method:    req.method,
+			Client:    req.client,
+			Elapsed:   now.Sub(req.started),
+			Remaining: "none",
+			Summary:   req.summary(),
+		}
+		if !req.deadline.IsZero() {
+			rows[i].Remaining = req.deadline.Sub(now).String()
+		}
+	}
+	return rows
+}
+
+// serveHTTP lists the in-flight requests on GET, and cancels the one whose ID is posted as
+// "cancel" if allowed.
+func (ir *inflightRequests) serveHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.Method == "POST" {
+		if !ir.allowCancel {
+			http.Error(w, "Cancelling requests is disabled", http.StatusForbidden)
+			return
+		}
+		id, err := strconv.ParseUint(req.FormValue("cancel"), 10, 64)
+		if err != nil {
+			http.Error(w, "Invalid request ID to cancel", http.StatusBadRequest)
+			return
+		}
+		if !ir.cancel(id) {
+			http.Error(w, "Request is no longer in flight", http.StatusNotFound)
+			return
+		}
+		http.Redirect(w, req, req.URL.Path, http.StatusSeeOther)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	data := struct {
+		Rows        []rpczRow
+		AllowCancel bool
+	}{ir.rows(time.Now()), ir.allowCancel}
+	if err := rpczTemplate.Execute(w, data); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+func newInflightRequests(allowCancel bool) *inflightRequests {
+	return &inflightRequests{
+		allowCancel: allowCancel,
+		requests:    make(map[uint64]*inflightRequest),
+	}
+}
+
+type byStarted []*inflightRequest
+
+func (requests byStarted) Len() int {
+	return len(requests)
+}
+
+func (requests byStarted) Less(i, j int) bool {
+	return requests[i].started.Before(requests[j].started)
+}
+
+func (requests byStarted) Swap(i, j int) {
+	requests[i], requests[j] = requests[j], requests[i]
+}
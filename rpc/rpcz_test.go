@@ -0,0 +1,173 @@
+package rpc
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"gen/pb/rpc/rpc_proto"
+
+	"github.com/golang/protobuf/proto"
+	"golang.org/x/net/context"
+
+	"github.com/xinlaini/golibs/log"
+)
+
+// summarize lists request, decoded as msg unless nil, on a fresh /rpcz and returns its summary.
+func summarize(request *rpc_proto.Request, msg proto.Message) string {
+	ir := newInflightRequests(false)
+	ir.add(&ServerContext{Context: context.Background()}, func() {}, request, msg)
+	return ir.rows(time.Now())[0].Summary
+}
+
+func TestInflightRequestSummary(t *testing.T) {
+	msg := &rpc_proto.KeyValue{Value: proto.String("a")}
+	msgBytes, err := proto.Marshal(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	textFlags := proto.Uint32(uint32(rpc_proto.Flag_TEXT_PB_PAYLOAD))
+	for _, test := range []struct {
+		request *rpc_proto.Request
+		msg     proto.Message
+		want    string
+	}{
+		{&rpc_proto.Request{RequestPb: msgBytes}, msg, proto.CompactTextString(msg)},
+		{&rpc_proto.Request{}, nil, "<nil>"},
+		{&rpc_proto.Request{RequestPb: []byte("abc")}, nil, "<3 bytes>"},
+		{&rpc_proto.Request{
+			Metadata:  &rpc_proto.RequestMetadata{Flags: textFlags},
+			RequestPb: []byte(`value: "a"`),
+		}, nil, `value: "a"`},
+		{&rpc_proto.Request{
+			Metadata:  &rpc_proto.RequestMetadata{Flags: textFlags},
+			RequestPb: []byte(strings.Repeat("a", maxRequestSummaryLen+1)),
+		}, nil, strings.Repeat("a", maxRequestSummaryLen) + "..."},
+	} {
+		if got := summarize(test.request, test.msg); got != test.want {
+			t.Errorf("Got summary %q, want %q", got, test.want)
+		}
+	}
+}
+
+func TestInflightRequestsWhileHandlersModifyThem(t *testing.T) {
+	mux := http.NewServeMux()
+	ctrl, err := NewController(Config{
+		Logger:  xlog.NewNilLogger(),
+		HTTPMux: mux,
+		Services: map[string]ServiceConfig{
+			"Raw": {Raw: func(ctx *ServerContext, requestPB []byte) ([]byte, error) {
+				for !isDone(ctx) {
+					requestPB[0]++
+				}
+				return nil, nil
+			}},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	l := NewPipeListener()
+	defer l.Close()
+	go ctrl.ServeListener(l)
+	c, err := newTestController(t).NewClient(ClientOptions{
+		ServiceName:  "Raw",
+		ServiceAddr:  "pipe",
+		ConnPoolSize: 1,
+		Retry:        DefaultDialRetry,
+		Dial:         l.Dial,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	done := make(chan error, 1)
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		defer cancel()
+		_, err := c.CallWithTextPB("Get", &ClientContext{Context: ctx}, proto.String(`value: "a"`))
+		done <- err
+	}()
+	for {
+		select {
+		case <-done:
+			return
+		default:
+		}
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, httptest.NewRequest("GET", "/rpcz", nil))
+		if w.Code != http.StatusOK {
+			t.Fatalf("/rpcz returned %d", w.Code)
+		}
+	}
+}
+
+func isDone(ctx *ServerContext) bool {
+	select {
+	case <-ctx.Done():
+		return true
+	default:
+		return false
+	}
+}
+
+func TestInflightRequests(t *testing.T) {
+	for _, allowCancel := range []bool{false, true} {
+		ir := newInflightRequests(allowCancel)
+		ctx, cancel := context.WithCancel(context.Background())
+		untrack := ir.add(
+			&ServerContext{Context: ctx},
+			cancel,
+			&rpc_proto.Request{Metadata: &rpc_proto.RequestMetadata{
+				ServiceName: proto.String("KV"),
+				MethodName:  proto.String("Get"),
+			}},
+			&rpc_proto.KeyValue{Value: proto.String("a")})
+
+		w := httptest.NewRecorder()
+		ir.serveHTTP(w, httptest.NewRequest("GET", "/rpcz", nil))
+		if !strings.Contains(w.Body.String(), "KV.Get") {
+			t.Errorf("/rpcz doesn't list the request:\n%s", w.Body)
+		}
+		if hasButton := strings.Contains(w.Body.String(), "Cancel"); hasButton != allowCancel {
+			t.Errorf("/rpcz shows a cancel button: %t, with cancelling allowed: %t", hasButton, allowCancel)
+		}
+
+		w = httptest.NewRecorder()
+		req := httptest.NewRequest("POST", "/rpcz", strings.NewReader(url.Values{"cancel": {"1"}}.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		ir.serveHTTP(w, req)
+		wantCode := http.StatusForbidden
+		if allowCancel {
+			wantCode = http.StatusSeeOther
+		}
+		if w.Code != wantCode {
+			t.Errorf("Cancelling the request returned %d, want %d", w.Code, wantCode)
+		}
+		if cancelled := ctx.Err() != nil; cancelled != allowCancel {
+			t.Errorf("Request is cancelled: %t, with cancelling allowed: %t", cancelled, allowCancel)
+		}
+
+		untrack()
+		cancel()
+		if rows := ir.rows(time.Now()); len(rows) != 0 {
+			t.Errorf("Got %d rows after untracking, want 0", len(rows))
+		}
+	}
+}
+
+func TestInflightRequestsNeedHTTPMux(t *testing.T) {
+	for _, mux := range []*http.ServeMux{nil, http.NewServeMux()} {
+		ctrl, err := NewController(Config{Logger: xlog.NewNilLogger(), HTTPMux: mux})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if tracked := ctrl.inflight != nil; tracked != (mux != nil) {
+			t.Errorf("Requests tracked: %t, with HTTPMux: %t", tracked, mux != nil)
+		}
+	}
+}
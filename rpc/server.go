@@ -7,80 +7,231 @@ import (
 	"fmt"
 	"io"
 	"net"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
 
 	"gen/pb/rpc/rpc_proto"
 
+	"golang.org/x/net/context"
+
 	"github.com/golang/protobuf/proto"
 	"github.com/xinlaini/golibs/log"
 )
 
 type server struct {
-	logger   xlog.Logger
-	services map[string]*service
+	logger      xlog.Logger
+	services    map[string]*service
+	mtxServices sync.RWMutex
+	idleTimeout time.Duration
+	jobName     string
+	host        string
+	// idempotency is nil if disabled.
+	idempotency *idempotencyCache
+	// dispatcher is nil if requests run as they arrive.
+	dispatcher *dispatcher
+	faults     *faultInjector
+	// accessLog is nil if disabled.
+	accessLog *accessLog
+
+	maxBatchSize        int
+	maxBatchConcurrency int
 }
 
 func (svr *server) serve(port int) error {
-	if len(svr.services) == 0 {
-		return errors.New("No service to serve")
-	}
 	l, err := net.Listen("tcp", fmt.Sprintf(":%d", port))
 	if err != nil {
 		return err
 	}
-	defer l.Close()
 	svr.logger.Infof("Start listening on TCP port %d...", port)
+	return svr.serveListener(l, nil)
+}
+
+// serveAll binds every listener before serving any, then serves them all until one of them
+// fails, which closes the others.
+func (svr *server) serveAll(listeners []ListenerConfig) error {
+	if len(listeners) == 0 {
+		return errors.New("No listener to serve on")
+	}
+	for _, cfg := range listeners {
+		for _, name := range cfg.Services {
+			if _, found := svr.service(name); !found {
+				return fmt.Errorf("ListenerConfig.Services names unknown service '%s'", name)
+			}
+		}
+	}
+	ls := make([]net.Listener, len(listeners))
+	for i, cfg := range listeners {
+		l := cfg.Listener
+		if l == nil {
+			network := cfg.Network
+			if network == "" {
+				network = "tcp"
+			}
+			var err error
+			if l, err = net.Listen(network, cfg.Addr); err != nil {
+				for _, bound := range ls[:i] {
+					bound.Close()
+				}
+				return err
+			}
+		}
+		ls[i] = l
+	}
+
+	errs := make(chan error, len(ls))
+	for i, l := range ls {
+		var allowed map[string]bool
+		if len(listeners[i].Services) > 0 {
+			allowed = make(map[string]bool)
+			for _, name := range listeners[i].Services {
+				allowed[name] = true
+			}
+			svr.logger.Infof("Start listening on '%s' for services %v...", l.Addr(), listeners[i].Services)
+		} else {
+			svr.logger.Infof("Start listening on '%s' for all services...", l.Addr())
+		}
+		go func(l net.Listener, allowed map[string]bool) {
+			errs <- svr.serveListener(l, allowed)
+		}(l, allowed)
+	}
+	err := <-errs
+	for _, l := range ls {
+		l.Close()
+	}
+	for i := 1; i < len(ls); i++ {
+		<-errs
+	}
+	return err
+}
+
+// serveListener serves on l, even before any service is registered. If allowed is not nil,
+// only the services in it are exposed.
+func (svr *server) serveListener(l net.Listener, allowed map[string]bool) error {
+	defer l.Close()
 
 	for {
 		conn, err := l.Accept()
 		if err != nil {
-			svr.logger.Errorf("TCP accept failed with error: %s", err)
-			continue
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				svr.logger.Errorf("Accept on '%s' failed with error: %s", l.Addr(), err)
+				continue
+			}
+			// The listener is closed or broken, stop serving.
+			return err
 		}
-		go svr.handleConn(conn)
+		go svr.handleConn(conn, allowed)
 	}
 }
 
-func (svr *server) handleConn(conn net.Conn) {
+func (svr *server) handleConn(conn net.Conn, allowed map[string]bool) {
 	// If this function returns, the connection must have lost its integrity.
 	defer conn.Close()
 
+	conn, caps := svr.negotiate(conn)
+	if conn == nil {
+		return
+	}
+	checksums := caps&CapChecksums != 0
+	// The size of the next request is read outside of pooled frames, so that idle
+	// connections don't hold any.
+	requestSize := make([]byte, 4)
 	for {
-		requestBytes := svr.readRequest(conn)
-		if requestBytes == nil {
-			return
+		if svr.idleTimeout > 0 {
+			if err := conn.SetReadDeadline(time.Now().Add(svr.idleTimeout)); err != nil {
+				svr.logger.Errorf("Failed to set read deadline: %s", err)
+				return
+			}
 		}
-		response, svc := svr.serveRequest(conn, requestBytes[4:])
-		responseBytes, err := proto.Marshal(response)
-		if err != nil {
-			svr.logger.Errorf("Failed to marshal response: %s", err)
+		request, received := svr.readRequest(conn, requestSize, checksums)
+		if request == nil {
 			return
 		}
-		responseSize := make([]byte, 4)
-		binary.BigEndian.PutUint32(responseSize, uint32(len(responseBytes)))
-
-		if _, err = conn.Write(responseSize); err != nil {
-			svr.logger.Errorf("Failed to write 4 bytes for response size: %s", err)
-			return
+		if len(request.payload()) == 0 {
+			putFrame(request)
+			// An empty frame is a keepalive ping, answer it in kind.
+			if _, err := conn.Write(pingFrame); err != nil {
+				svr.logger.Errorf("Failed to write 4 bytes for ping response: %s", err)
+				return
+			}
+			continue
 		}
-		if _, err = conn.Write(responseBytes); err != nil {
-			svr.logger.Errorf("Failed to write %d bytes for response: %s", len(responseBytes), err)
+		if !svr.serveFrame(conn, request, received, checksums, allowed) {
 			return
 		}
-		if svc != nil {
-			go svc.log(requestBytes, responseSize, responseBytes)
-		}
 	}
 }
 
-func (svr *server) serveRequest(conn net.Conn, requestBytes []byte) (*rpc_proto.Response, *service) {
-	request := &rpc_proto.Request{}
-	response := &rpc_proto.Response{}
+// serveFrame serves the request in a frame received at the given time, and writes the
+// response. It returns false if the connection should be closed.
+func (svr *server) serveFrame(
+	conn net.Conn, request *frame, received time.Time, checksums bool, allowed map[string]bool) bool {
+	defer putFrame(request)
+	response, svc := svr.serveRequest(conn, request.payload(), received, allowed)
+	if response == nil {
+		svr.logger.Infof("Dropping connection from '%s' by fault injection", conn.RemoteAddr())
+		return false
+	}
+	responseFrame := getFrame()
+	defer putFrame(responseFrame)
+	if err := responseFrame.marshal(response); err != nil {
+		svr.logger.Errorf("Failed to marshal response: %s", err)
+		return false
+	}
+	if err := responseFrame.write(conn, checksums); err != nil {
+		svr.logger.Errorf("Failed to write %d bytes for response: %s", len(responseFrame.buf), err)
+		return false
+	}
+	if svc != nil {
+		svc.log(request, responseFrame)
+	}
+	return true
+}
 
-	var err error
-	if err = proto.Unmarshal(requestBytes, request); err != nil {
+// serveRequest serves a request received at the given time, on a listener exposing the allowed
+// services, or all of them if nil.
+func (svr *server) serveRequest(
+	conn net.Conn,
+	requestBytes []byte,
+	received time.Time,
+	allowed map[string]bool) (*rpc_proto.Response, *service) {
+	request := &rpc_proto.Request{}
+	if err := proto.Unmarshal(requestBytes, request); err != nil {
+		response := svr.newResponse()
 		response.Error = makeServerErrf("Failed to unmarshal request: %s", err)
+		svr.logRejected(conn, received, len(requestBytes), response.GetError())
 		return response, nil
 	}
+	if len(request.Batch) > 0 {
+		return svr.serveBatch(conn, request, received, allowed), nil
+	}
+	return svr.dispatch(conn, request, received, allowed)
+}
+
+func (svr *server) newResponse() *rpc_proto.Response {
+	return &rpc_proto.Response{
+		Metadata: &rpc_proto.ResponseMetadata{
+			ServerJobName: proto.String(svr.jobName),
+			ServerHost:    proto.String(svr.host),
+		},
+	}
+}
+
+// dispatch runs request on its service. It returns a nil response if the connection should be
+// dropped.
+func (svr *server) dispatch(
+	conn net.Conn,
+	request *rpc_proto.Request,
+	received time.Time,
+	allowed map[string]bool) (response *rpc_proto.Response, svc *service) {
+	if svr.accessLog != nil {
+		defer func() {
+			svr.accessLog.record(request, response, received)
+		}()
+	}
+	response = svr.newResponse()
 	if request.Metadata == nil {
 		response.Error = makeServerErr("Request is missing metadata")
 		return response, nil
@@ -90,49 +241,259 @@ func (svr *server) serveRequest(conn net.Conn, requestBytes []byte) (*rpc_proto.
 		response.Error = makeServerErr("Request.Metadata is missing service_name")
 		return response, nil
 	}
-	svc, found := svr.services[request.Metadata.GetServiceName()]
+	svc, found := svr.service(request.Metadata.GetServiceName())
+	if allowed != nil && !allowed[request.Metadata.GetServiceName()] {
+		// Hide the services not exposed on this listener.
+		found = false
+	}
 	if !found {
 		response.Error = makeServerErrf("Service '%s' is not found", request.Metadata.GetServiceName())
 		return response, nil
 	}
-	svc.serveRequest(request, response)
+	reqMeta := request.Metadata
+	if err := svr.injectFault(reqMeta); err == errFaultDropped {
+		return nil, nil
+	} else if err != nil {
+		response.Error = proto.String(err.Error())
+		return response, nil
+	}
+	// Wait in the queue, or for a call with the same idempotency key, no longer than the method
+	// would run.
+	timeout, _ := svc.timeout(reqMeta)
+	var finish func()
+	if svr.dispatcher != nil {
+		if err := svr.dispatcher.admit(Priority(reqMeta.GetPriority()), timeout); err != nil {
+			response.Error = makeServerErr(err.Error())
+			return response, nil
+		}
+		finish = svr.dispatcher.release
+	}
+	// The method handler takes over finish, so that a handler still running past its deadline
+	// keeps its dispatcher slot.
+	defer func() {
+		callFinish(finish)
+	}()
+	serve := func() bool {
+		handlerFinish := finish
+		finish = nil
+		return svc.serveRequest(request, response, received, handlerFinish)
+	}
+	if key := reqMeta.GetIdempotencyKey(); key != "" && svr.idempotency != nil {
+		svr.idempotency.serve(
+			fmt.Sprintf("%s.%s/%s", reqMeta.GetServiceName(), reqMeta.GetMethodName(), key),
+			request.RequestPb,
+			received,
+			timeout,
+			response,
+			serve)
+	} else {
+		serve()
+	}
 	return response, svc
 }
 
-func (svr *server) readRequest(conn net.Conn) []byte {
-	buf := bytes.NewBuffer(make([]byte, 0, 4))
-	var err error
-	if _, err = io.CopyN(buf, conn, 4); err != nil {
+func (svr *server) injectFault(reqMeta *rpc_proto.RequestMetadata) error {
+	ctx := context.Background()
+	if timeoutUs := reqMeta.GetTimeoutUs(); timeoutUs > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, time.Duration(timeoutUs)*time.Microsecond)
+		defer cancel()
+	}
+	return svr.faults.inject(ctx, false, reqMeta)
+}
+
+// negotiate answers the handshake of the client, if it sends one. It returns the connection
+// to serve requests on, or nil if it should be closed, and the negotiated capabilities.
+func (svr *server) negotiate(conn net.Conn) (net.Conn, Capabilities) {
+	if svr.idleTimeout > 0 {
+		if err := conn.SetReadDeadline(time.Now().Add(svr.idleTimeout)); err != nil {
+			svr.logger.Errorf("Failed to set read deadline: %s", err)
+			return nil, 0
+		}
+	}
+	prefix := make([]byte, len(protocolMagic))
+	if _, err := io.ReadFull(conn, prefix); err != nil {
 		if err != io.EOF {
+			svr.logger.Errorf("Failed to read first 4 bytes from '%s': %s", conn.RemoteAddr(), err)
+		}
+		return nil, 0
+	}
+	if bytes.Equal(prefix, protocolMagic) {
+		version, caps, err := serverHandshake(conn, prefix)
+		if err != nil {
+			svr.logger.Errorf("Handshake with '%s' failed: %s", conn.RemoteAddr(), err)
+			svr.logRejected(conn, time.Now(), 0, fmt.Sprintf("Handshake failed: %s", err))
+			return nil, 0
+		}
+		svr.logger.Infof(
+			"Connection from '%s' speaks protocol v%d with capabilities %s",
+			conn.RemoteAddr(), version, caps)
+		return conn, caps
+	}
+	// A legacy client, whose first frame is already started.
+	if binary.BigEndian.Uint32(prefix) > maxLegacyFrameSize {
+		svr.logger.Errorf("Closing connection from '%s': %s", conn.RemoteAddr(), errBadMagic)
+		svr.logRejected(conn, time.Now(), 0, errBadMagic.Error())
+		return nil, 0
+	}
+	return &prefixedConn{Conn: conn, r: io.MultiReader(bytes.NewReader(prefix), conn)}, 0
+}
+
+// logRejected records a request or connection rejected before dispatch in the access log.
+func (svr *server) logRejected(conn net.Conn, received time.Time, requestSize int, err string) {
+	if svr.accessLog != nil {
+		svr.accessLog.recordRejected(conn.RemoteAddr().String(), received, requestSize, err)
+	}
+}
+
+// readRequest reads a request frame into a pooled frame, using sizeBuf to wait for it, and
+// verifies its checksum if enabled. It returns nil if the connection should be closed, and
+// otherwise when the request size arrived, so that queue delays include reading the payload.
+func (svr *server) readRequest(conn net.Conn, sizeBuf []byte, checksums bool) (*frame, time.Time) {
+	if _, err := io.ReadFull(conn, sizeBuf); err != nil {
+		if ne, ok := err.(net.Error); ok && ne.Timeout() {
+			svr.logger.Infof(
+				"Closing connection from '%s' after %s without traffic",
+				conn.RemoteAddr().String(), svr.idleTimeout.String())
+		} else if err != io.EOF {
 			svr.logger.Errorf(
 				"Failed to read 4 bytes for request size from '%s': %s",
 				conn.RemoteAddr().String(), err)
 		}
-		return nil
+		return nil, time.Time{}
 	}
-	requestSize := binary.BigEndian.Uint32(buf.Bytes())
-	if _, err = io.CopyN(buf, conn, int64(requestSize)); err != nil {
+	received := time.Now()
+	requestSize := binary.BigEndian.Uint32(sizeBuf)
+	request := getFrame()
+	request.buf = append(request.buf[:0], sizeBuf...)
+	if err := request.readPayload(conn, requestSize); err != nil {
 		if err != io.EOF {
 			svr.logger.Errorf(
 				"Failed to read %d bytes for request from '%s': %s",
 				requestSize, conn.RemoteAddr().String(), err)
 		}
-		return nil
+		putFrame(request)
+		return nil, time.Time{}
+	}
+	if checksums && requestSize > 0 {
+		ok, err := request.verifyChecksum(conn)
+		if err != nil {
+			svr.logger.Errorf(
+				"Failed to read 4 bytes for request checksum from '%s': %s",
+				conn.RemoteAddr().String(), err)
+			putFrame(request)
+			return nil, time.Time{}
+		}
+		if !ok {
+			svr.logger.Errorf(
+				"Closing connection from '%s': request checksum mismatch", conn.RemoteAddr().String())
+			putFrame(request)
+			return nil, time.Time{}
+		}
+	}
+	return request, received
+}
+
+func (svr *server) service(name string) (*service, bool) {
+	svr.mtxServices.RLock()
+	defer svr.mtxServices.RUnlock()
+	svc, found := svr.services[name]
+	return svc, found
+}
+
+func (svr *server) registerService(name string, svc *service) error {
+	svr.mtxServices.Lock()
+	defer svr.mtxServices.Unlock()
+	if _, found := svr.services[name]; found {
+		return fmt.Errorf("Service '%s' is already registered", name)
 	}
-	return buf.Bytes()
+	svr.services[name] = svc
+	return nil
 }
 
-func newServer(ctrl *Controller, services map[string]ServiceConfig) (*server, error) {
+func (svr *server) unregisterService(name string) error {
+	svr.mtxServices.Lock()
+	svc, found := svr.services[name]
+	delete(svr.services, name)
+	svr.mtxServices.Unlock()
+
+	if !found {
+		return fmt.Errorf("Service '%s' is not registered", name)
+	}
+	svc.close()
+	return nil
+}
+
+func newServer(ctrl *Controller, config *Config) (*server, error) {
 	svr := &server{
-		logger:   ctrl.logger,
-		services: make(map[string]*service),
+		logger:      ctrl.logger,
+		services:    make(map[string]*service),
+		idleTimeout: config.ConnIdleTimeout,
+		jobName:     os.Args[0],
+		faults:      ctrl.faults,
+
+		maxBatchSize:        config.MaxBatchSize,
+		maxBatchConcurrency: config.MaxBatchConcurrency,
+	}
+	var err error
+	if svr.host, err = os.Hostname(); err != nil {
+		return nil, err
+	}
+	if config.IdempotencyCacheSize < 0 || config.IdempotencyTTL < 0 {
+		return nil, errors.New("Config.IdempotencyCacheSize and IdempotencyTTL must be >=0")
+	}
+	if config.IdempotencyCacheSize > 0 {
+		ttl := config.IdempotencyTTL
+		if ttl == 0 {
+			ttl = DefaultIdempotencyTTL
+		}
+		svr.idempotency = newIdempotencyCache(config.IdempotencyCacheSize, ttl)
+	}
+	if config.MaxConcurrentRequests < 0 || config.MaxQueuedRequests < 0 {
+		return nil, errors.New("Config.MaxConcurrentRequests and MaxQueuedRequests must be >=0")
+	}
+	if config.MaxBatchSize < 0 || config.MaxBatchConcurrency < 0 {
+		return nil, errors.New("Config.MaxBatchSize and MaxBatchConcurrency must be >=0")
 	}
-	for name, cfg := range services {
+	if svr.maxBatchSize == 0 {
+		svr.maxBatchSize = DefaultMaxBatchSize
+	}
+	if svr.maxBatchConcurrency == 0 {
+		svr.maxBatchConcurrency = DefaultMaxBatchConcurrency
+	}
+	if config.AccessLog != nil {
+		if svr.accessLog, err = newAccessLog(ctrl.logger, *config.AccessLog); err != nil {
+			return nil, err
+		}
+	}
+	if config.MaxConcurrentRequests > 0 {
+		maxQueued := config.MaxQueuedRequests
+		if maxQueued == 0 {
+			maxQueued = config.MaxConcurrentRequests
+		}
+		svr.dispatcher = newDispatcher(config.MaxConcurrentRequests, maxQueued)
+	}
+	// Report the errors of all services at once, in a stable order.
+	names := make([]string, 0, len(config.Services))
+	for name := range config.Services {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var errs []string
+	for _, name := range names {
+		cfg := config.Services[name]
 		svc, err := newService(ctrl, name, &cfg)
 		if err != nil {
-			return nil, err
+			errs = append(errs, fmt.Sprintf("Service '%s': %s", name, err))
+			continue
 		}
 		svr.services[name] = svc
 	}
+	if len(errs) > 0 {
+		for _, svc := range svr.services {
+			svc.close()
+		}
+		return nil, errors.New(strings.Join(errs, "\n"))
+	}
 	return svr, nil
 }
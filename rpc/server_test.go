@@ -0,0 +1,196 @@
+package rpc_test
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"gen/pb/rpc/rpc_proto"
+
+	"github.com/golang/protobuf/proto"
+	"golang.org/x/net/context"
+
+	"github.com/xinlaini/golibs/rpc"
+	"github.com/xinlaini/golibs/rpc/rpctest"
+)
+
+// rawCall sends request over conn as a client without handshake, pausing for delay between
+// the size prefix and the payload, and returns the response.
+func rawCall(t *testing.T, conn net.Conn, request *rpc_proto.Request, delay time.Duration) *rpc_proto.Response {
+	requestBytes, err := proto.Marshal(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	size := make([]byte, 4)
+	binary.BigEndian.PutUint32(size, uint32(len(requestBytes)))
+	if _, err := conn.Write(size); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(delay)
+	if _, err := conn.Write(requestBytes); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.ReadFull(conn, size); err != nil {
+		t.Fatal(err)
+	}
+	responseBytes := make([]byte, binary.BigEndian.Uint32(size))
+	if _, err := io.ReadFull(conn, responseBytes); err != nil {
+		t.Fatal(err)
+	}
+	response := &rpc_proto.Response{}
+	if err := proto.Unmarshal(responseBytes, response); err != nil {
+		t.Fatal(err)
+	}
+	return response
+}
+
+func TestResponseMetadata(t *testing.T) {
+	s, c := startPipeServer(t, rpc.Config{
+		Services: map[string]rpc.ServiceConfig{
+			"Sleep": {
+				Raw: func(ctx *rpc.ServerContext, requestPB []byte) ([]byte, error) {
+					time.Sleep(20 * time.Millisecond)
+					return requestPB, nil
+				},
+				Methods: map[string]rpc.MethodConfig{"Get": {DefaultDeadline: time.Second}},
+			},
+		},
+	}, "Sleep")
+	defer s.Close()
+	defer c.Close()
+
+	ctx := &rpc.ClientContext{Context: context.Background()}
+	if _, err := call(c, ctx, "Get", "a"); err != nil {
+		t.Fatal(err)
+	}
+	respMeta := ctx.Metadata
+	host, _ := os.Hostname()
+	if respMeta.GetServerJobName() != os.Args[0] || respMeta.GetServerHost() != host {
+		t.Errorf("Response comes from job %q on %q", respMeta.GetServerJobName(), respMeta.GetServerHost())
+	}
+	if latency := respMeta.GetHandlerLatencyUs(); latency < 20000 {
+		t.Errorf("HandlerLatencyUs = %d, want >=20000", latency)
+	}
+	if applied := respMeta.GetAppliedTimeoutUs(); applied != 1000000 {
+		t.Errorf("AppliedTimeoutUs = %d, want 1000000", applied)
+	}
+	if ctx.RoundTripTime < 20*time.Millisecond || ctx.NetworkTime > ctx.RoundTripTime {
+		t.Errorf("RoundTripTime = %s, NetworkTime = %s", ctx.RoundTripTime, ctx.NetworkTime)
+	}
+}
+
+func TestQueueDelayIncludesReadingRequest(t *testing.T) {
+	s, err := rpctest.StartPipeServer(rpc.Config{
+		Services: map[string]rpc.ServiceConfig{"Echo": echoService()},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	conn, err := s.Listener.(*rpc.PipeListener).Dial("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	response := rawCall(t, conn, &rpc_proto.Request{
+		Metadata: &rpc_proto.RequestMetadata{
+			ServiceName: proto.String("Echo"),
+			MethodName:  proto.String("Get"),
+		},
+		RequestPb: []byte("a"),
+	}, 50*time.Millisecond)
+	if response.Error != nil {
+		t.Fatal(response.GetError())
+	}
+	if delay := response.GetMetadata().GetQueueDelayUs(); delay < 50000 {
+		t.Errorf("QueueDelayUs = %d, want >=50000 for a request whose payload arrived 50ms late", delay)
+	}
+}
+
+func TestQueueTimeoutFollowsMethodDeadline(t *testing.T) {
+	var (
+		entered = make(chan struct{})
+		release = make(chan struct{})
+	)
+	l, opts := startCountingServer(t, rpc.Config{
+		Services: map[string]rpc.ServiceConfig{
+			"Queue": {
+				Raw: func(ctx *rpc.ServerContext, requestPB []byte) ([]byte, error) {
+					if ctx.Metadata.GetMethodName() == "Block" {
+						close(entered)
+						<-release
+					}
+					return requestPB, nil
+				},
+				Methods: map[string]rpc.MethodConfig{"Get": {DefaultDeadline: 20 * time.Millisecond}},
+			},
+		},
+		MaxConcurrentRequests: 1,
+		MaxQueuedRequests:     1,
+	}, "Queue")
+	defer l.Close()
+	// Separate clients, so that Get doesn't wait for the connection Block holds.
+	blockClient := newClient(t, opts)
+	defer blockClient.Close()
+	c := newClient(t, opts)
+	defer c.Close()
+	blocked := make(chan error, 1)
+	go func() {
+		_, err := call(blockClient, &rpc.ClientContext{Context: context.Background()}, "Block", "a")
+		blocked <- err
+	}()
+	<-entered
+
+	// Without a client deadline, Get waits in the queue for its DefaultDeadline at most.
+	_, err := call(c, &rpc.ClientContext{Context: context.Background()}, "Get", "a")
+	if err == nil || !strings.Contains(err.Error(), "queue") {
+		t.Errorf("Get behind a blocked call failed with %v, want a queue timeout", err)
+	}
+	close(release)
+	if err := <-blocked; err != nil {
+		t.Error(err)
+	}
+}
+
+func TestTimedOutHandlerKeepsItsSlot(t *testing.T) {
+	release := make(chan struct{})
+	l, opts := startCountingServer(t, rpc.Config{
+		Services: map[string]rpc.ServiceConfig{
+			"Queue": {
+				Raw: func(ctx *rpc.ServerContext, requestPB []byte) ([]byte, error) {
+					if ctx.Metadata.GetMethodName() == "Slow" {
+						<-release
+					}
+					return requestPB, nil
+				},
+				Methods: map[string]rpc.MethodConfig{
+					"Slow": {DefaultDeadline: 10 * time.Millisecond},
+					"Get":  {DefaultDeadline: 20 * time.Millisecond},
+				},
+			},
+		},
+		MaxConcurrentRequests: 1,
+	}, "Queue")
+	defer l.Close()
+	c := newClient(t, opts)
+	defer c.Close()
+
+	background := &rpc.ClientContext{Context: context.Background()}
+	if _, err := call(c, background, "Slow", "a"); err == nil || !strings.Contains(err.Error(), "timed out") {
+		t.Fatalf("Slow failed with %v, want a timeout", err)
+	}
+	// The timed out handler still runs, so Get can't.
+	if _, err := call(c, background, "Get", "a"); err == nil || !strings.Contains(err.Error(), "queue") {
+		t.Errorf("Get beside a timed out handler failed with %v, want a queue timeout", err)
+	}
+	close(release)
+	waitFor(t, "the slot to be released", func() bool {
+		_, err := call(c, background, "Get", "a")
+		return err == nil
+	})
+}
@@ -5,6 +5,8 @@ import (
 	"os"
 	"path/filepath"
 	"reflect"
+	"runtime/debug"
+	"strings"
 	"sync"
 	"time"
 
@@ -32,11 +34,16 @@ type method struct {
 }
 
 type service struct {
-	logger         xlog.Logger
-	methods        map[string]*method
-	chLog          chan [3][]byte
-	recentCalls    [recentIngressCount][3][]byte
-	mtxRecentCalls sync.RWMutex
+	logger          xlog.Logger
+	methods         map[string]*method
+	raw             RawHandler
+	methodConfigs   map[string]MethodConfig
+	propagatePanics bool
+	stats           map[string]*MethodStats
+	mtxStats        sync.Mutex
+	calls           *callLog
+	closed          chan struct{}
+	inflight        *inflightRequests
 }
 
 func (svc *service) logLoop(binaryLogDir, name string) {
@@ -52,16 +59,23 @@ func (svc *service) logLoop(binaryLogDir, name string) {
 		}
 	}
 
-	next := 0
 	for {
-		data := <-svc.chLog
-		svc.mtxRecentCalls.Lock()
-		svc.recentCalls[next] = data
-		svc.mtxRecentCalls.Unlock()
-		next = (next + 1) % recentIngressCount
+		var call loggedCall
+		select {
+		case <-svc.closed:
+			if binaryLog != nil {
+				svc.logger.Infof("Binary log '%s' is now closed", binaryLog.Name())
+				binaryLog.Close()
+			}
+			return
+		case call = <-svc.calls.ch:
+		}
+		if dropped := svc.calls.takeDropped(); dropped > 0 {
+			svc.logger.Errorf("Dropped %d calls from the binary log, writing fell behind", dropped)
+		}
 		if binaryLog != nil {
 			for i := 0; i < 3; i++ {
-				if _, err := binaryLog.Write(data[i]); err != nil {
+				if _, err := binaryLog.Write(call.data[i]); err != nil {
 					svc.logger.Errorf(
 						"Failed to write to '%s', it's now closed and may be compromised: %s",
 						binaryLog.Name(), err)
@@ -71,21 +85,33 @@ func (svc *service) logLoop(binaryLogDir, name string) {
 				}
 			}
 		}
+		call.release()
 	}
 }
 
-func (svc *service) serveRequest(request *rpc_proto.Request, response *rpc_proto.Response) {
+// serveRequest serves a request received at the given time. It returns false if the method
+// panicked, or timed out and may still be running. finish, unless nil, is called once the
+// method handler returns, even after serving gave up on it, or right away if it doesn't run.
+func (svc *service) serveRequest(
+	request *rpc_proto.Request, response *rpc_proto.Response, received time.Time, finish func()) bool {
 	reqMeta := request.Metadata
 	var err error
 	if reqMeta.MethodName == nil {
 		response.Error = makeServerErr("Request.Metadata is missing method_name")
-		return
+		callFinish(finish)
+		return true
+	}
+	if svc.raw != nil {
+		return svc.serveRawRequest(request, response, received, finish)
 	}
+	defer func() {
+		callFinish(finish)
+	}()
 	m, found := svc.methods[reqMeta.GetMethodName()]
 	if !found {
 		response.Error = makeServerErrf(
 			"Method '%s.%s' is not found", reqMeta.GetServiceName(), reqMeta.GetMethodName())
-		return
+		return true
 	}
 	var requestPB reflect.Value
 	if request.RequestPb == nil {
@@ -104,26 +130,36 @@ func (svc *service) serveRequest(request *rpc_proto.Request, response *rpc_proto
 				reqMeta.GetServiceName(),
 				reqMeta.GetMethodName(),
 				err)
-			return
+			return true
 		}
 	}
 
-	parentCtx := context.Background()
-	if reqMeta.GetTimeoutUs() > 0 {
-		parentCtx, _ = context.WithTimeout(parentCtx, time.Duration(reqMeta.GetTimeoutUs())*time.Microsecond)
-	}
-	ctx := &ServerContext{
-		Context:  parentCtx,
-		Metadata: reqMeta,
+	var msg proto.Message
+	if !requestPB.IsNil() {
+		msg = requestPB.Interface().(proto.Message)
 	}
+	ctx, cancel := svc.newServerContext(request, msg)
+	defer cancel()
 
-	ch := make(chan []reflect.Value)
-	go func() {
-		ch <- m.body.Call([]reflect.Value{reflect.ValueOf(ctx), requestPB})
-	}()
+	handlerStart := time.Now()
+	defer setTiming(ctx, response, received, handlerStart)
+
+	call := newHandlerCall(svc, ctx, finish)
+	finish = nil
+	call.m = m
+	call.args[0], call.args[1] = reflect.ValueOf(ctx), requestPB
+	svc.start(call)
 
 	select {
-	case callResults := <-ch:
+	case <-call.done:
+		callResults, panicked := call.results, call.panicked
+		call.release()
+		if panicked {
+			response.Error = makeServerErrf(
+				"Method '%s.%s' panicked", reqMeta.GetServiceName(), reqMeta.GetMethodName())
+			return false
+		}
+		setResponseMD(ctx, response)
 		if callResults[1].IsNil() {
 			if !callResults[0].IsNil() {
 				msg := callResults[0].Interface().(proto.Message)
@@ -135,7 +171,7 @@ func (svc *service) serveRequest(request *rpc_proto.Request, response *rpc_proto
 						reqMeta.GetServiceName(),
 						reqMeta.GetMethodName(),
 						err)
-					return
+					return true
 				}
 			}
 		} else {
@@ -143,21 +179,297 @@ func (svc *service) serveRequest(request *rpc_proto.Request, response *rpc_proto
 			response.Error = proto.String(callResults[1].Interface().(error).Error())
 		}
 	case <-ctx.Done():
-		response.Error = makeServerErrf(
-			"Method '%s.%s' timed out", reqMeta.GetServiceName(), reqMeta.GetMethodName())
+		response.Error = doneError(ctx, reqMeta)
+		return false
+	}
+	return true
+}
+
+func (svc *service) serveRawRequest(
+	request *rpc_proto.Request, response *rpc_proto.Response, received time.Time, finish func()) bool {
+	reqMeta := request.Metadata
+	ctx, cancel := svc.newServerContext(request, nil)
+	defer cancel()
+
+	handlerStart := time.Now()
+	defer setTiming(ctx, response, received, handlerStart)
+
+	call := newHandlerCall(svc, ctx, finish)
+	call.requestPB = request.RequestPb
+	svc.start(call)
+
+	select {
+	case <-call.done:
+		responsePB, err, panicked := call.responsePB, call.err, call.panicked
+		call.release()
+		if panicked {
+			response.Error = makeServerErrf(
+				"Method '%s.%s' panicked", reqMeta.GetServiceName(), reqMeta.GetMethodName())
+			return false
+		}
+		setResponseMD(ctx, response)
+		if err != nil {
+			// This is an app-level error.
+			response.Error = proto.String(err.Error())
+		} else {
+			response.ResponsePb = responsePB
+		}
+	case <-ctx.Done():
+		response.Error = doneError(ctx, reqMeta)
+		return false
+	}
+	return true
+}
+
+// handlerCall runs a method handler on its own goroutine, so that serving can give up on it
+// at the deadline. Calls are pooled, except those given up on, which the handler may still
+// write to.
+type handlerCall struct {
+	svc *service
+	ctx *ServerContext
+	// m and args are set for typed handlers, requestPB for raw ones.
+	m         *method
+	args      [2]reflect.Value
+	requestPB []byte
+	// finish, unless nil, is called once the handler returns.
+	finish func()
+
+	results    []reflect.Value
+	responsePB []byte
+	err        error
+	panicked   bool
+	// done is buffered, so that the handler doesn't leak if it finishes after the timeout.
+	done chan struct{}
+}
+
+var (
+	handlerCallPool = sync.Pool{
+		New: func() interface{} {
+			return &handlerCall{done: make(chan struct{}, 1)}
+		},
+	}
+)
+
+func newHandlerCall(svc *service, ctx *ServerContext, finish func()) *handlerCall {
+	call := handlerCallPool.Get().(*handlerCall)
+	call.svc, call.ctx, call.finish = svc, ctx, finish
+	return call
+}
+
+// start runs call on its own goroutine if serving may give up on it, i.e. if it has a deadline
+// or /rpcz may cancel it. Otherwise, serving waits for the handler anyway, so it runs inline.
+func (svc *service) start(call *handlerCall) {
+	if call.ctx.timeout == 0 && (svc.inflight == nil || !svc.inflight.allowCancel) {
+		call.run()
 		return
 	}
+	go call.run()
+}
+
+func (call *handlerCall) run() {
+	defer func() {
+		if r := recover(); r != nil {
+			call.svc.handlePanic(call.ctx.Metadata, r)
+			call.panicked = true
+		}
+		callFinish(call.finish)
+		call.done <- struct{}{}
+	}()
+	if call.m != nil {
+		call.results = call.m.body.Call(call.args[:])
+	} else {
+		call.responsePB, call.err = call.svc.raw(call.ctx, call.requestPB)
+	}
+}
+
+// callFinish calls finish unless nil.
+func callFinish(finish func()) {
+	if finish != nil {
+		finish()
+	}
+}
+
+// release returns a call whose done was received to the pool.
+func (call *handlerCall) release() {
+	done := call.done
+	*call = handlerCall{done: done}
+	handlerCallPool.Put(call)
+}
+
+// doneError returns the error of a call whose context is done before the method returns.
+func doneError(ctx *ServerContext, reqMeta *rpc_proto.RequestMetadata) *string {
+	if ctx.Err() == context.Canceled {
+		return makeServerErrf(
+			"Method '%s.%s' was cancelled", reqMeta.GetServiceName(), reqMeta.GetMethodName())
+	}
+	return makeServerErrf(
+		"Method '%s.%s' timed out", reqMeta.GetServiceName(), reqMeta.GetMethodName())
+}
+
+// handlePanic must be called with the recovered value of a panicking method handler. It
+// re-panics if the controller is configured to propagate panics.
+func (svc *service) handlePanic(reqMeta *rpc_proto.RequestMetadata, r interface{}) {
+	svc.logger.Errorf(
+		"Method '%s.%s' panicked: %v\n%s",
+		reqMeta.GetServiceName(), reqMeta.GetMethodName(), r, debug.Stack())
+	svc.updateStats(reqMeta.GetMethodName(), func(stats *MethodStats) {
+		stats.Panics++
+	})
+	if svc.propagatePanics {
+		panic(r)
+	}
+}
+
+func (svc *service) updateStats(methodName string, update func(*MethodStats)) {
+	svc.mtxStats.Lock()
+	defer svc.mtxStats.Unlock()
+
+	stats, found := svc.stats[methodName]
+	if !found {
+		stats = &MethodStats{}
+		svc.stats[methodName] = stats
+	}
+	update(stats)
+}
+
+func (svc *service) methodStats(methodName string) MethodStats {
+	svc.mtxStats.Lock()
+	defer svc.mtxStats.Unlock()
+
+	if stats, found := svc.stats[methodName]; found {
+		return *stats
+	}
+	return MethodStats{}
+}
+
+// log records a call with the given request and response frames.
+func (svc *service) log(request, response *frame) {
+	svc.calls.record(request, response, [3][]byte{request.buf, response.buf[:4], response.payload()})
+}
+
+// close stops logging once the service is unregistered. Calls in flight still complete.
+func (svc *service) close() {
+	close(svc.closed)
+}
+
+// newServerContext creates the context of a request, decoded as msg unless nil. The request is
+// listed on /rpcz, if served, until cancelled.
+func (svc *service) newServerContext(
+	request *rpc_proto.Request, msg proto.Message) (*ServerContext, context.CancelFunc) {
+	reqMeta := request.Metadata
+	timeout, clamped := svc.timeout(reqMeta)
+	if clamped {
+		svc.updateStats(reqMeta.GetMethodName(), func(stats *MethodStats) {
+			stats.ClampedDeadlines++
+		})
+	}
+
+	var (
+		parentCtx context.Context
+		cancel    context.CancelFunc
+	)
+	if timeout > 0 {
+		parentCtx, cancel = context.WithTimeout(context.Background(), timeout)
+	} else {
+		parentCtx, cancel = context.WithCancel(context.Background())
+	}
+	ctx := &ServerContext{
+		Context:         parentCtx,
+		Metadata:        reqMeta,
+		DeadlineClamped: clamped,
+		timeout:         timeout,
+		RequestHeader:   mdFromPB(reqMeta.GetHeaders()),
+		ResponseHeader:  make(MD),
+		ResponseTrailer: make(MD),
+	}
+	if svc.inflight == nil {
+		return ctx, cancel
+	}
+	untrack := svc.inflight.add(ctx, cancel, request, msg)
+	return ctx, func() {
+		untrack()
+		cancel()
+	}
 }
 
-func (svc *service) log(requestBytes, responseSize, responseBytes []byte) {
-	svc.chLog <- [3][]byte{requestBytes, responseSize, responseBytes}
+// timeout applies the default and maximum deadlines of the method to the timeout sent by the
+// client, 0 means no deadline. It also returns whether the client's timeout was cut short.
+func (svc *service) timeout(reqMeta *rpc_proto.RequestMetadata) (time.Duration, bool) {
+	cfg := svc.methodConfigs[reqMeta.GetMethodName()]
+	timeout := time.Duration(reqMeta.GetTimeoutUs()) * time.Microsecond
+	if timeout <= 0 {
+		timeout = cfg.DefaultDeadline
+	}
+	if cfg.MaxDeadline <= 0 || (timeout > 0 && timeout <= cfg.MaxDeadline) {
+		return timeout, false
+	}
+	return cfg.MaxDeadline, reqMeta.GetTimeoutUs() > 0
+}
+
+// setTiming reports how long the request queued before and ran in its method handler.
+func setTiming(ctx *ServerContext, response *rpc_proto.Response, received, handlerStart time.Time) {
+	respMeta := responseMetadata(response)
+	respMeta.QueueDelayUs = proto.Int64(int64(handlerStart.Sub(received) / time.Microsecond))
+	respMeta.HandlerLatencyUs = proto.Int64(int64(time.Now().Sub(handlerStart) / time.Microsecond))
+	if ctx.timeout > 0 {
+		respMeta.AppliedTimeoutUs = proto.Int64(int64(ctx.timeout / time.Microsecond))
+	}
 }
 
 func isPBPtr(typ reflect.Type) bool {
 	return typ.Kind() == reflect.Ptr && typ.Implements(pbMessageType)
 }
 
+// signatureError tells why a method can't be served, or returns "" if it can.
+func signatureError(mType reflect.Type) string {
+	if mType.NumIn() != 2 {
+		return fmt.Sprintf("takes %d arguments, must take 2", mType.NumIn())
+	}
+	if mType.In(0) != serverCtxPtrType {
+		return fmt.Sprintf("first argument is '%s', must be '%s'", mType.In(0), serverCtxPtrType)
+	}
+	if !isPBPtr(mType.In(1)) {
+		return fmt.Sprintf("second argument '%s' is not a proto message pointer", mType.In(1))
+	}
+	if mType.NumOut() != 2 {
+		return fmt.Sprintf("returns %d results, must return 2", mType.NumOut())
+	}
+	if !isPBPtr(mType.Out(0)) {
+		return fmt.Sprintf("first result '%s' is not a proto message pointer", mType.Out(0))
+	}
+	if mType.Out(1) != errorType {
+		return fmt.Sprintf("second result is '%s', must be 'error'", mType.Out(1))
+	}
+	return ""
+}
+
 func newService(ctrl *Controller, name string, cfg *ServiceConfig) (*service, error) {
+	for mName, mCfg := range cfg.Methods {
+		if mCfg.DefaultDeadline < 0 || mCfg.MaxDeadline < 0 {
+			return nil, fmt.Errorf("Deadlines of method '%s.%s' must be >=0", name, mName)
+		}
+		if mCfg.MaxDeadline > 0 && mCfg.DefaultDeadline > mCfg.MaxDeadline {
+			return nil, fmt.Errorf("DefaultDeadline of method '%s.%s' must be <= MaxDeadline", name, mName)
+		}
+	}
+	svc := &service{
+		logger:          ctrl.logger,
+		methods:         make(map[string]*method),
+		methodConfigs:   cfg.Methods,
+		propagatePanics: ctrl.propagatePanics,
+		stats:           make(map[string]*MethodStats),
+		calls:           newCallLog(recentIngressCount, ctrl.binaryLogDir != ""),
+		closed:          make(chan struct{}),
+		inflight:        ctrl.inflight,
+	}
+
+	if cfg.Raw != nil {
+		ctrl.logger.Infof("Will serve all methods of '%s' with a raw handler", name)
+		svc.raw = cfg.Raw
+		go svc.logLoop(ctrl.binaryLogDir, name)
+		return svc, nil
+	}
+
 	if cfg.Type.Kind() != reflect.Interface {
 		return nil, fmt.Errorf("'%s' is not an Interface kind", cfg.Type)
 	}
@@ -166,30 +478,35 @@ func newService(ctrl *Controller, name string, cfg *ServiceConfig) (*service, er
 		return nil, fmt.Errorf("'%s' does not implement '%s'", reflect.TypeOf(cfg.Impl), cfg.Type)
 	}
 
-	svc := &service{
-		logger:  ctrl.logger,
-		methods: make(map[string]*method),
-		chLog:   make(chan [3][]byte),
-	}
-
+	var rejected []string
 	implValue := reflect.ValueOf(cfg.Impl)
 	for i := 0; i < cfg.Type.NumMethod(); i++ {
 		mName := cfg.Type.Method(i).Name
 		m := implValue.MethodByName(mName)
-		mType := m.Type()
 		// Validate method signature.
-		if mType.NumIn() != 2 || mType.In(0) != serverCtxPtrType || !isPBPtr(mType.In(1)) {
-			continue
-		}
-		if mType.NumOut() != 2 || !isPBPtr(mType.Out(0)) || mType.Out(1) != errorType {
+		if reason := signatureError(m.Type()); reason != "" {
+			if ctrl.strictServices {
+				rejected = append(rejected, fmt.Sprintf("'%s.%s' %s", name, mName, reason))
+			} else {
+				ctrl.logger.Errorf("Will not serve method '%s.%s', it %s", name, mName, reason)
+			}
 			continue
 		}
+		mType := m.Type()
 		ctrl.logger.Infof("Will serve method '%s.%s'", name, mName)
 		svc.methods[mName] = &method{
 			requestType: mType.In(1).Elem(),
 			body:        m,
 		}
 	}
+	if len(rejected) > 0 {
+		return nil, fmt.Errorf("Rejected methods:\n%s", strings.Join(rejected, "\n"))
+	}
+	for mName := range cfg.Methods {
+		if _, found := svc.methods[mName]; !found {
+			return nil, fmt.Errorf("ServiceConfig of '%s' configures unknown method '%s'", name, mName)
+		}
+	}
 	go svc.logLoop(ctrl.binaryLogDir, name)
 	return svc, nil
 }
@@ -0,0 +1,266 @@
+package rpc_test
+
+import (
+	"reflect"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"gen/pb/rpc/rpc_proto"
+
+	"golang.org/x/net/context"
+
+	"github.com/xinlaini/golibs/log"
+	"github.com/xinlaini/golibs/rpc"
+)
+
+// kvService is a typed service of tests.
+type kvService interface {
+	Get(ctx *rpc.ServerContext, request *rpc_proto.KeyValue) (*rpc_proto.KeyValue, error)
+	Crash(ctx *rpc.ServerContext, request *rpc_proto.KeyValue) (*rpc_proto.KeyValue, error)
+}
+
+type kvServiceImpl struct{}
+
+func (kvServiceImpl) Get(ctx *rpc.ServerContext, request *rpc_proto.KeyValue) (*rpc_proto.KeyValue, error) {
+	return kv("value of " + request.GetValue()), nil
+}
+
+func (kvServiceImpl) Crash(ctx *rpc.ServerContext, request *rpc_proto.KeyValue) (*rpc_proto.KeyValue, error) {
+	panic("Crash")
+}
+
+func kvServiceConfig() rpc.ServiceConfig {
+	return rpc.ServiceConfig{
+		Type: reflect.TypeOf((*kvService)(nil)).Elem(),
+		Impl: kvServiceImpl{},
+	}
+}
+
+func TestHandlerPanics(t *testing.T) {
+	s, c := startPipeServer(t, rpc.Config{
+		Services: map[string]rpc.ServiceConfig{
+			"KV": kvServiceConfig(),
+			"Raw": {Raw: func(ctx *rpc.ServerContext, requestPB []byte) ([]byte, error) {
+				panic("Crash")
+			}},
+		},
+	}, "KV")
+	defer s.Close()
+	defer c.Close()
+	raw, err := s.NewClient("Raw")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer raw.Close()
+
+	for i := 0; i < 2; i++ {
+		if _, err := call(c, nil, "Crash", "a"); err == nil || !strings.Contains(err.Error(), "panicked") {
+			t.Errorf("Crash error = %v, want a panic", err)
+		}
+		if _, err := call(raw, nil, "Crash", "a"); err == nil || !strings.Contains(err.Error(), "panicked") {
+			t.Errorf("Raw Crash error = %v, want a panic", err)
+		}
+	}
+	if got, err := call(c, nil, "Get", "a"); err != nil || got != "value of a" {
+		t.Errorf("Get after panics = %q, %v", got, err)
+	}
+	if panics := s.Controller.MethodStats("KV", "Crash").Panics; panics != 2 {
+		t.Errorf("KV.Crash panicked %d times, want 2", panics)
+	}
+	if panics := s.Controller.MethodStats("Raw", "Crash").Panics; panics != 2 {
+		t.Errorf("Raw.Crash panicked %d times, want 2", panics)
+	}
+	if panics := s.Controller.MethodStats("KV", "Get").Panics; panics != 0 {
+		t.Errorf("KV.Get panicked %d times, want 0", panics)
+	}
+}
+
+// deadlineService reports the deadline its handlers got, and blocks until it is reached.
+func deadlineService(deadlines chan<- time.Duration, clamped chan<- bool) rpc.ServiceConfig {
+	return rpc.ServiceConfig{
+		Raw: func(ctx *rpc.ServerContext, requestPB []byte) ([]byte, error) {
+			deadline, ok := ctx.Deadline()
+			if !ok {
+				deadlines <- 0
+				clamped <- ctx.DeadlineClamped
+				return requestPB, nil
+			}
+			deadlines <- time.Until(deadline)
+			clamped <- ctx.DeadlineClamped
+			<-ctx.Done()
+			return nil, ctx.Err()
+		},
+		Methods: map[string]rpc.MethodConfig{
+			"Default": {DefaultDeadline: 50 * time.Millisecond},
+			"Max":     {MaxDeadline: 50 * time.Millisecond},
+		},
+	}
+}
+
+func TestMethodDeadlines(t *testing.T) {
+	deadlines, clamped := make(chan time.Duration, 1), make(chan bool, 1)
+	s, c := startPipeServer(t, rpc.Config{
+		Services: map[string]rpc.ServiceConfig{"Deadline": deadlineService(deadlines, clamped)},
+	}, "Deadline")
+	defer s.Close()
+	defer c.Close()
+
+	for _, test := range []struct {
+		methodName  string
+		timeout     time.Duration
+		min, max    time.Duration
+		wantClamped bool
+	}{
+		// The client deadline is propagated in microseconds.
+		{"Unconfigured", 200 * time.Millisecond, 100 * time.Millisecond, 200 * time.Millisecond, false},
+		{"Default", 0, 0, 50 * time.Millisecond, false},
+		{"Default", 200 * time.Millisecond, 100 * time.Millisecond, 200 * time.Millisecond, false},
+		{"Max", 0, 0, 50 * time.Millisecond, false},
+		{"Max", 5 * time.Second, 0, 50 * time.Millisecond, true},
+	} {
+		ctx := &rpc.ClientContext{Context: context.Background()}
+		if test.timeout > 0 {
+			var cancel context.CancelFunc
+			ctx.Context, cancel = context.WithTimeout(ctx.Context, test.timeout)
+			defer cancel()
+		}
+		if _, err := call(c, ctx, test.methodName, "a"); err == nil {
+			t.Errorf("%s with timeout %s didn't time out", test.methodName, test.timeout)
+		}
+		if deadline := <-deadlines; deadline <= test.min || deadline > test.max {
+			t.Errorf(
+				"%s with timeout %s got a deadline in %s, want in (%s, %s]",
+				test.methodName, test.timeout, deadline, test.min, test.max)
+		}
+		if got := <-clamped; got != test.wantClamped {
+			t.Errorf("%s with timeout %s got DeadlineClamped %t", test.methodName, test.timeout, got)
+		}
+	}
+	if n := s.Controller.MethodStats("Deadline", "Max").ClampedDeadlines; n != 1 {
+		t.Errorf("Max clamped %d deadlines, want 1", n)
+	}
+}
+
+func TestMethodDeadlineValidation(t *testing.T) {
+	for _, cfg := range []rpc.MethodConfig{
+		{DefaultDeadline: -time.Second},
+		{MaxDeadline: -time.Second},
+		{DefaultDeadline: 2 * time.Second, MaxDeadline: time.Second},
+	} {
+		_, err := rpc.NewController(rpc.Config{
+			Logger: xlog.NewNilLogger(),
+			Services: map[string]rpc.ServiceConfig{
+				"KV": {Raw: echoService().Raw, Methods: map[string]rpc.MethodConfig{"Get": cfg}},
+			},
+		})
+		if err == nil {
+			t.Errorf("MethodConfig %+v is valid", cfg)
+		}
+	}
+	config := kvServiceConfig()
+	config.Methods = map[string]rpc.MethodConfig{"Put": {DefaultDeadline: time.Second}}
+	_, err := rpc.NewController(rpc.Config{
+		Logger:   xlog.NewNilLogger(),
+		Services: map[string]rpc.ServiceConfig{"KV": config},
+	})
+	if err == nil {
+		t.Error("MethodConfig of an unknown method is valid")
+	}
+}
+
+func TestIdempotentCalls(t *testing.T) {
+	var runs int32
+	s, c := startPipeServer(t, rpc.Config{
+		Services: map[string]rpc.ServiceConfig{
+			"Counter": {Raw: func(ctx *rpc.ServerContext, requestPB []byte) ([]byte, error) {
+				if atomic.AddInt32(&runs, 1) == 1 && ctx.Metadata.GetMethodName() == "PanicOnce" {
+					panic("Crash")
+				}
+				return requestPB, nil
+			}},
+		},
+		IdempotencyCacheSize: 10,
+	}, "Counter")
+	defer s.Close()
+	defer c.Close()
+
+	for _, test := range []struct {
+		methodName string
+		wantRuns   int32
+	}{
+		{"Add", 1},
+		// The panicked call isn't replayed to the retry.
+		{"PanicOnce", 2},
+	} {
+		atomic.StoreInt32(&runs, 0)
+		for i := 0; i < 3; i++ {
+			ctx, cancel := newCtx()
+			ctx.IdempotencyKey = "key"
+			_, err := call(c, ctx, test.methodName, "a")
+			cancel()
+			if i > 0 && err != nil {
+				t.Errorf("Retry %d of %s failed with %v", i, test.methodName, err)
+			}
+			if replayed := ctx.Metadata.GetReplayed(); replayed != (atomic.LoadInt32(&runs) < int32(i+1)) {
+				t.Errorf("Call %d of %s has Replayed %t", i, test.methodName, replayed)
+			}
+		}
+		if n := atomic.LoadInt32(&runs); n != test.wantRuns {
+			t.Errorf("%s ran %d times, want %d", test.methodName, n, test.wantRuns)
+		}
+	}
+
+	ctx, cancel := newCtx()
+	defer cancel()
+	ctx.IdempotencyKey = "key"
+	if _, err := call(c, ctx, "Add", "b"); err != rpc.ErrIdempotencyKeyReused {
+		t.Errorf("Reusing the key with another request failed with %v, want %v", err, rpc.ErrIdempotencyKeyReused)
+	}
+}
+
+func TestIdempotentCallWaitFollowsMethodDeadline(t *testing.T) {
+	var (
+		entered = make(chan struct{})
+		release = make(chan struct{})
+	)
+	l, opts := startCountingServer(t, rpc.Config{
+		Services: map[string]rpc.ServiceConfig{
+			"Block": {
+				Raw: func(ctx *rpc.ServerContext, requestPB []byte) ([]byte, error) {
+					close(entered)
+					<-release
+					return requestPB, nil
+				},
+				Methods: map[string]rpc.MethodConfig{"Get": {DefaultDeadline: 20 * time.Millisecond}},
+			},
+		},
+		IdempotencyCacheSize: 10,
+	}, "Block")
+	defer l.Close()
+	// Separate clients, so that the duplicate doesn't wait for the connection of the first call.
+	firstClient := newClient(t, opts)
+	defer firstClient.Close()
+	c := newClient(t, opts)
+	defer c.Close()
+	first := make(chan error, 1)
+	go func() {
+		ctx, cancel := newCtx()
+		defer cancel()
+		ctx.IdempotencyKey = "key"
+		_, err := call(firstClient, ctx, "Get", "a")
+		first <- err
+	}()
+	<-entered
+
+	// Without a client deadline, the duplicate waits for the DefaultDeadline at most.
+	ctx := &rpc.ClientContext{Context: context.Background(), IdempotencyKey: "key"}
+	if _, err := call(c, ctx, "Get", "a"); err == nil || !strings.Contains(err.Error(), "Timed out waiting") {
+		t.Errorf("Duplicate of a blocked call failed with %v, want a timeout", err)
+	}
+	close(release)
+	if err := <-first; err != nil {
+		t.Error(err)
+	}
+}
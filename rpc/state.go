@@ -0,0 +1,132 @@
+package rpc
+
+import (
+	"fmt"
+
+	"golang.org/x/net/context"
+)
+
+// ConnectivityState is the state of the connection pool of a Client.
+type ConnectivityState int
+
+const (
+	// Connecting means no connection is established yet, but none has failed either.
+	Connecting ConnectivityState = iota
+	// Ready means at least one connection has been established.
+	Ready
+	// TransientFailure means no connection is established and the last dial failed.
+	TransientFailure
+	// Shutdown means the Client is closed.
+	Shutdown
+	// Idle means no connection is established or wanted, as the pool is empty until a call
+	// or WaitForReady needs one. Only a pool with ConnPoolSize 0 can be Idle.
+	Idle
+)
+
+var (
+	// ErrUnavailable is returned by fail-fast calls while the service is unreachable.
+	ErrUnavailable = makeClientErr("Service is unavailable")
+)
+
+func (s ConnectivityState) String() string {
+	switch s {
+	case Connecting:
+		return "CONNECTING"
+	case Ready:
+		return "READY"
+	case TransientFailure:
+		return "TRANSIENT_FAILURE"
+	case Shutdown:
+		return "SHUTDOWN"
+	case Idle:
+		return "IDLE"
+	}
+	return fmt.Sprintf("ConnectivityState(%d)", int(s))
+}
+
+func (c *Client) State() ConnectivityState {
+	state, _ := c.stateAndChan()
+	return state
+}
+
+// WaitForStateChange blocks until the state differs from source, and returns true, or until
+// ctx is done, and returns false.
+func (c *Client) WaitForStateChange(ctx context.Context, source ConnectivityState) bool {
+	for {
+		state, changed := c.stateAndChan()
+		if state != source {
+			return true
+		}
+		select {
+		case <-ctx.Done():
+			return false
+		case <-changed:
+		}
+	}
+}
+
+// WaitForReady blocks until a connection is established, e.g. at startup, dialing one if the
+// Client is Idle. It fails if ctx is done or the Client is closed first.
+func (c *Client) WaitForReady(ctx context.Context) error {
+	for {
+		state, changed := c.stateAndChan()
+		switch state {
+		case Ready:
+			return nil
+		case Shutdown:
+			return makeClientErr("Client is closed")
+		case Idle:
+			c.grow()
+		}
+		select {
+		case <-ctx.Done():
+			return makeClientErr(ctx.Err().Error())
+		case <-changed:
+		}
+	}
+}
+
+// stateAndChan returns the current state and a channel closed on its next change.
+func (c *Client) stateAndChan() (ConnectivityState, <-chan struct{}) {
+	c.mtxState.Lock()
+	defer c.mtxState.Unlock()
+	return c.state, c.stateChanged
+}
+
+func (c *Client) setState(state ConnectivityState) {
+	c.mtxState.Lock()
+	defer c.mtxState.Unlock()
+	c.setStateLocked(state)
+}
+
+// leaveIdle sets Connecting if the Client is Idle, once it dials again.
+func (c *Client) leaveIdle() {
+	c.mtxState.Lock()
+	defer c.mtxState.Unlock()
+	if c.state == Idle {
+		c.setStateLocked(Connecting)
+	}
+}
+
+func (c *Client) setStateLocked(state ConnectivityState) {
+	// Shutdown is final.
+	if c.state == state || c.state == Shutdown {
+		return
+	}
+	c.logger.Infof(
+		"Client for '%s' to '%s' changed from %s to %s",
+		c.serviceName, c.serviceAddr, c.state, state)
+	c.state = state
+	close(c.stateChanged)
+	c.stateChanged = make(chan struct{})
+}
+
+// setStateIfNoConn sets state if no connection is established.
+func (c *Client) setStateIfNoConn(state ConnectivityState) {
+	c.mtxEntries.RLock()
+	noConn := len(c.entries) == 0
+	c.mtxEntries.RUnlock()
+	if noConn {
+		c.setState(state)
+	}
+}
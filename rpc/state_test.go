@@ -0,0 +1,177 @@
+package rpc_test
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/xinlaini/golibs/rpc"
+)
+
+// flakyDialer fails to dial until it is healed.
+type flakyDialer struct {
+	l       *rpc.PipeListener
+	healthy bool
+	mtx     sync.Mutex
+}
+
+func (d *flakyDialer) dial(addr string) (net.Conn, error) {
+	d.mtx.Lock()
+	healthy := d.healthy
+	d.mtx.Unlock()
+	if !healthy {
+		return nil, errors.New("Connection refused")
+	}
+	return d.l.Dial(addr)
+}
+
+func (d *flakyDialer) heal() {
+	d.mtx.Lock()
+	d.healthy = true
+	d.mtx.Unlock()
+}
+
+func TestStateTransitions(t *testing.T) {
+	l, opts := startCountingServer(t, rpc.Config{
+		Services: map[string]rpc.ServiceConfig{"Echo": echoService()},
+	}, "Echo")
+	defer l.Close()
+	d := &flakyDialer{l: l.PipeListener}
+	opts.Dial = d.dial
+	c := newClient(t, opts)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if !c.WaitForStateChange(ctx, rpc.Connecting) {
+		t.Fatal("Client stayed Connecting")
+	}
+	if state := c.State(); state != rpc.TransientFailure {
+		t.Fatalf("State() = %s, want TRANSIENT_FAILURE", state)
+	}
+
+	failFast, cancelFailFast := newCtx()
+	failFast.FailFast = true
+	_, err := call(c, failFast, "Echo", "a")
+	cancelFailFast()
+	if err != rpc.ErrUnavailable {
+		t.Errorf("Fail-fast call in TRANSIENT_FAILURE failed with %v, want ErrUnavailable", err)
+	}
+	shortCtx, cancelShort := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	_, err = call(c, &rpc.ClientContext{Context: shortCtx}, "Echo", "a")
+	cancelShort()
+	if err == nil || err == rpc.ErrUnavailable {
+		t.Errorf("Waiting call in TRANSIENT_FAILURE failed with %v, want a deadline error", err)
+	}
+	shortCtx, cancelShort = context.WithTimeout(context.Background(), 20*time.Millisecond)
+	err = c.WaitForReady(shortCtx)
+	cancelShort()
+	if err == nil {
+		t.Error("WaitForReady() succeeded in TRANSIENT_FAILURE")
+	}
+
+	d.heal()
+	if err := c.WaitForReady(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if state := c.State(); state != rpc.Ready {
+		t.Errorf("State() = %s, want READY", state)
+	}
+	if _, err := call(c, nil, "Echo", "a"); err != nil {
+		t.Error(err)
+	}
+
+	c.Close()
+	if state := c.State(); state != rpc.Shutdown {
+		t.Errorf("State() = %s after Close(), want SHUTDOWN", state)
+	}
+	if err := c.WaitForReady(ctx); err == nil {
+		t.Error("WaitForReady() succeeded after Close()")
+	}
+}
+
+func TestFailFastWaitsWhileConnecting(t *testing.T) {
+	l, opts := startCountingServer(t, rpc.Config{
+		Services: map[string]rpc.ServiceConfig{"Echo": echoService()},
+	}, "Echo")
+	defer l.Close()
+	unblock := make(chan struct{})
+	opts.Dial = func(addr string) (net.Conn, error) {
+		<-unblock
+		return l.Dial(addr)
+	}
+	c := newClient(t, opts)
+	defer c.Close()
+
+	if state := c.State(); state != rpc.Connecting {
+		t.Fatalf("State() = %s, want CONNECTING", state)
+	}
+	done := make(chan error, 1)
+	go func() {
+		ctx, cancel := newCtx()
+		defer cancel()
+		ctx.FailFast = true
+		_, err := call(c, ctx, "Echo", "a")
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		t.Fatalf("Fail-fast call returned %v while CONNECTING", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+	close(unblock)
+	if err := <-done; err != nil {
+		t.Error(err)
+	}
+}
+
+func TestIdleState(t *testing.T) {
+	l, opts := startCountingServer(t, rpc.Config{
+		Services: map[string]rpc.ServiceConfig{"Echo": echoService()},
+	}, "Echo")
+	defer l.Close()
+	opts.ConnPoolSize = 0
+	opts.MaxConnPoolSize = 1
+	opts.PoolShrinkIdleTime = 20 * time.Millisecond
+	c := newClient(t, opts)
+	defer c.Close()
+
+	if state := c.State(); state != rpc.Idle {
+		t.Fatalf("State() = %s with ConnPoolSize 0, want IDLE", state)
+	}
+	// WaitForReady dials rather than waiting for a call to.
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := c.WaitForReady(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	// Once its only connection is retired, the Client is Idle again.
+	if !c.WaitForStateChange(ctx, rpc.Ready) {
+		t.Fatal("Client stayed READY")
+	}
+	if state, size := c.State(), c.Stats().PoolSize; state != rpc.Idle || size != 0 {
+		t.Errorf("State() = %s with PoolSize %d after shrinking, want IDLE with 0", state, size)
+	}
+	if _, err := call(c, nil, "Echo", "a"); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestConnectivityStateString(t *testing.T) {
+	for state, want := range map[rpc.ConnectivityState]string{
+		rpc.Connecting:       "CONNECTING",
+		rpc.Ready:            "READY",
+		rpc.TransientFailure: "TRANSIENT_FAILURE",
+		rpc.Shutdown:         "SHUTDOWN",
+		rpc.Idle:             "IDLE",
+		42:                   "ConnectivityState(42)",
+	} {
+		if got := state.String(); got != want {
+			t.Errorf("String() = %q, want %q", got, want)
+		}
+	}
+}